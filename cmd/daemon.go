@@ -17,10 +17,19 @@ package cmd
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	sshagent "golang.org/x/crypto/ssh/agent"
 )
 
 // daemonCmd represents the daemon command
@@ -28,50 +37,326 @@ var daemonCmd = &cobra.Command{
 	Use:   "daemon",
 	Short: "Starts the ssh-emissary daemon in the background",
 	Long: `
-	Starts the ssh-emissary as a daemon`,
-	Run: runDaemon,
+	Starts the ssh-emissary as a daemon, and prints shell commands which
+	set SSH_AUTH_SOCK and SSH_AGENT_PID, in the manner of ssh-agent:
+
+	  eval $(ssh-emissary daemon)
+
+	If the daemon is already running, it is reused. The shell syntax is
+	chosen from $SHELL unless -s, -c or --fish is given. With --kill, the
+	running daemon is stopped.
+
+	The daemon detaches from the terminal and logs to --log.`,
+	Args: cobra.NoArgs,
+	RunE: runDaemon,
 }
 
-func runDaemon(cmd *cobra.Command, args []string) {
+// startTimeout is how long we wait for the daemon to start listening
+const startTimeout = 30 * time.Second
+
+// killTimeout limits how long we wait for the daemon's socket to answer
+// before stopping it
+const killTimeout = 5 * time.Second
+
+// shell syntaxes for daemon output
+const (
+	shellSh   = "sh"
+	shellCsh  = "csh"
+	shellFish = "fish"
+)
+
+func daemonShell(cmd *cobra.Command) string {
+	if ok, _ := cmd.Flags().GetBool("sh"); ok {
+		return shellSh
+	}
+	if ok, _ := cmd.Flags().GetBool("csh"); ok {
+		return shellCsh
+	}
+	if ok, _ := cmd.Flags().GetBool("fish"); ok {
+		return shellFish
+	}
+
+	sh := os.Getenv("SHELL")
+	switch {
+	case strings.HasSuffix(sh, "csh"):
+		return shellCsh
+	case strings.HasSuffix(sh, "fish"):
+		return shellFish
+	default:
+		return shellSh
+	}
+}
+
+func printSetenv(shell, name, value string) {
+	switch shell {
+	case shellCsh:
+		fmt.Printf("setenv %s %s;\n", name, value)
+	case shellFish:
+		fmt.Printf("set -x %s %s;\n", name, value)
+	default:
+		fmt.Printf("%s=%s; export %s;\n", name, value, name)
+	}
+}
+
+func printUnsetenv(shell, name string) {
+	switch shell {
+	case shellCsh:
+		fmt.Printf("unsetenv %s;\n", name)
+	case shellFish:
+		fmt.Printf("set -e %s;\n", name)
+	default:
+		fmt.Printf("unset %s;\n", name)
+	}
+}
+
+// pidfilePath returns the path of the daemon's pidfile. It holds the
+// daemon's PID and socket path on separate lines
+func pidfilePath() (string, error) {
+	dir, err := lib.RuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "daemon.pid"), nil
+}
+
+// readPidfile returns the PID and socket of the running daemon, or 0 if it
+// isn't running
+func readPidfile(file string) (int, string) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, ""
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil || pid <= 0 {
+		return 0, ""
+	}
+
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		// Not running
+		return 0, ""
+	}
+
+	var sock string
+	if len(lines) > 1 {
+		sock = lines[1]
+	}
+	return pid, sock
+}
+
+func runDaemon(cmd *cobra.Command, args []string) error {
+	shell := daemonShell(cmd)
+
+	pidfile, err := pidfilePath()
+	if err != nil {
+		return err
+	}
+
+	if kill, _ := cmd.Flags().GetBool("kill"); kill {
+		return killDaemon(shell, pidfile)
+	}
+
+	if pid, sockPath := readPidfile(pidfile); pid != 0 && sockPath != "" {
+		if conn, err := net.Dial("unix", sockPath); err == nil {
+			conn.Close()
+			printSetenv(shell, "SSH_AUTH_SOCK", sockPath)
+			printSetenv(shell, "SSH_AGENT_PID", strconv.Itoa(pid))
+			fmt.Printf("echo Agent pid %d;\n", pid)
+			return nil
+		}
+	}
+
+	sockPath, err := lib.DefaultSocket()
+	if err != nil {
+		return err
+	}
+
+	// Perhaps started by systemd
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		conn.Close()
+		printSetenv(shell, "SSH_AUTH_SOCK", sockPath)
+		return nil
+	}
+
 	exe, err := os.Executable()
 	if err != nil {
-		fmt.Printf("Error getting path to own executable: %s\n", err.Error())
-		os.Exit(1)
+		return errors.Wrap(err, "Getting path to own executable")
+	}
+
+	logDest, err := cmd.Flags().GetString("log")
+	if err != nil {
+		return err
+	}
+	if logDest == "" {
+		dir, err := lib.StateDir()
+		if err != nil {
+			return err
+		}
+		logDest = path.Join(dir, "daemon.log")
+	}
+	logFile, err := openDaemonLog(logDest)
+	if err != nil {
+		return err
 	}
+	defer logFile.Close()
 
-	dir, err := ioutil.TempDir(os.Getenv("XDG_RUNTIME_DIR"), "ssh-emissary")
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
 	if err != nil {
-		fmt.Printf("Error creating temporary directory: %s\n", err.Error())
-		os.Exit(1)
+		return err
 	}
+	defer devNull.Close()
 
-	sockPath := path.Join(dir, "ssh-agent")
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
 
-	proc, err := os.StartProcess(exe, []string{exe, "serve", "--sock", sockPath}, &os.ProcAttr{Files: []*os.File{
-		os.Stdin,
-		os.Stderr,
-		os.Stderr,
-	}})
+	proc, err := os.StartProcess(exe, []string{exe, "serve", "--sock", sockPath, "--ready-fd", "3"}, &os.ProcAttr{
+		Dir:   "/",
+		Files: []*os.File{devNull, devNull, logFile, readyW},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	readyW.Close()
+	if err != nil {
+		return errors.Wrap(err, "Starting agent")
+	}
+
+	// The daemon writes its socket path once it is listening, and closes
+	// the pipe either way. If it hangs instead, we give up on it
+	readyR.SetReadDeadline(time.Now().Add(startTimeout))
+	ready, err := ioutil.ReadAll(readyR)
+	if err != nil || strings.TrimSpace(string(ready)) != sockPath {
+		proc.Kill()
+		proc.Wait()
+		if os.IsTimeout(err) {
+			return errors.Errorf("Agent didn't start within %s; see %s", startTimeout, logDest)
+		}
+		return errors.Errorf("Agent failed to start; see %s", logDest)
+	}
 
+	if err := ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n%s\n", proc.Pid, sockPath)), 0600); err != nil {
+		return errors.Wrapf(err, "Writing %s", pidfile)
+	}
+
+	printSetenv(shell, "SSH_AUTH_SOCK", sockPath)
+	printSetenv(shell, "SSH_AGENT_PID", strconv.Itoa(proc.Pid))
+	fmt.Printf("echo Agent pid %d;\n", proc.Pid)
+	return proc.Release()
+}
+
+// journalStream is the socket journald accepts log streams on
+const journalStream = "/run/systemd/journal/stdout"
+
+// openDaemonLog opens the daemon's log destination: a file, or "journal"
+// for the systemd journal
+func openDaemonLog(dest string) (*os.File, error) {
+	if dest != "journal" {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Opening log %s", dest)
+		}
+		return f, nil
+	}
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: journalStream, Net: "unix"})
 	if err != nil {
-		fmt.Printf("Error starting agent: %s\n", err.Error())
-		os.Exit(1)
+		return nil, errors.Wrap(err, "Connecting to the journal")
+	}
+	defer conn.Close()
+
+	if err := conn.CloseRead(); err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("SSH_AUTH_SOCK=%s\n", sockPath)
-	proc.Release()
+	// identifier, unit, priority, level prefix, and forwarding to syslog,
+	// kmsg and the console
+	if _, err := conn.Write([]byte("ssh-emissary\n\n6\n0\n0\n0\n0\n")); err != nil {
+		return nil, errors.Wrap(err, "Connecting to the journal")
+	}
+	return conn.File()
 }
 
-func init() {
-	rootCmd.AddCommand(daemonCmd)
+func killDaemon(shell, pidfile string) error {
+	pid, sock := readPidfile(pidfile)
+	if pid == 0 || !isDaemon(pid, sock) {
+		// Perhaps started some other way
+		pid, _ = strconv.Atoi(os.Getenv("SSH_AGENT_PID"))
+		sock = os.Getenv("SSH_AUTH_SOCK")
+	}
 
-	// Here you will define your flags and configuration settings.
+	// Either may be stale, and the PID since reused
+	if pid <= 0 || !isDaemon(pid, sock) {
+		return errors.New("ssh-emissary daemon is not running")
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// daemonCmd.PersistentFlags().String("foo", "", "A help for foo")
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return errors.Wrapf(err, "Killing %d", pid)
+	}
+	os.Remove(pidfile)
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// daemonCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	printUnsetenv(shell, "SSH_AUTH_SOCK")
+	printUnsetenv(shell, "SSH_AGENT_PID")
+	fmt.Printf("echo Agent pid %d killed;\n", pid)
+	return nil
+}
+
+// isDaemon returns whether pid is running the same executable as us, and
+// serving the agent on sock
+func isDaemon(pid int, sock string) bool {
+	exe, err := processExecutable(pid)
+	if err != nil {
+		return false
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(self); err == nil {
+		self = resolved
+	}
+
+	if filepath.IsAbs(exe) {
+		if exe != self {
+			return false
+		}
+	} else if exe != filepath.Base(self) {
+		// ps only gave us the name
+		return false
+	}
+
+	return servesAgent(pid, sock)
+}
+
+// servesAgent returns whether an agent answers on sock and, where we can
+// tell, whether it is pid
+func servesAgent(pid int, sock string) bool {
+	if sock == "" {
+		return false
+	}
+
+	conn, err := net.DialTimeout("unix", sock, killTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if peer, err := peerPid(conn); err == nil && peer != pid {
+		return false
+	}
+
+	conn.SetDeadline(time.Now().Add(killTimeout))
+	_, err = sshagent.NewClient(conn).List()
+	return err == nil
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().BoolP("sh", "s", false, "Print Bourne shell commands")
+	daemonCmd.Flags().BoolP("csh", "c", false, "Print C shell commands")
+	daemonCmd.Flags().Bool("fish", false, "Print fish commands")
+	daemonCmd.Flags().BoolP("kill", "k", false, "Stop the running daemon")
+	daemonCmd.Flags().String("log", "", `File to log to, or "journal" for the systemd journal (default $XDG_STATE_HOME/ssh-emissary/daemon.log)`)
 }
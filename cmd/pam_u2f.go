@@ -0,0 +1,240 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// systemCountersFile is where pam-u2f records counters when run as root
+const systemCountersFile = "/var/lib/ssh-emissary/u2f-counters.json"
+
+// pamU2FCmd represents the pam-u2f command
+var pamU2FCmd = &cobra.Command{
+	Use:   "pam-u2f",
+	Short: "Authenticate a PAM user with a U2F token, for use with pam_exec",
+	Long: `Authenticates the user being authenticated by PAM with a U2F token connected
+to their ssh-emissary agent, which may be forwarded from another machine.
+It is intended to be run by pam_exec, e.g. in /etc/pam.d/sudo:
+
+  auth sufficient pam_exec.so stdout /usr/bin/ssh-emissary pam-u2f
+
+The user's agent is found through SSH_AUTH_SOCK, either in the environment
+or in that of the process being authenticated (e.g. sudo). The socket must
+belong to the user.
+
+Keys are read from a mapping file in any format written by u2f-register,
+by default the pam_u2f file ~/.config/Yubico/u2f_keys of the user. It must
+not be a symlink, and must belong to the user or root and be writable only
+by its owner. As the user can add keys to a file in their home directory,
+prefer a root owned --authfile. The origin and AppID default to
+pam://$HOSTNAME, as in pam_u2f.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Only authentication is our business
+		if t := os.Getenv("PAM_TYPE"); t != "" && t != "auth" {
+			return nil
+		}
+
+		username := os.Getenv("PAM_USER")
+		if username == "" {
+			return errors.New("PAM_USER unset; run from pam_exec")
+		}
+
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+
+		appID, err := u2fAppID(cmd)
+		if err != nil {
+			return err
+		}
+
+		authfile, err := cmd.Flags().GetString("authfile")
+		if err != nil {
+			return err
+		}
+		if authfile == "" {
+			authfile = path.Join(u.HomeDir, ".config", "Yubico", "u2f_keys")
+		}
+
+		counters, err := cmd.Flags().GetString("counters")
+		if err != nil {
+			return err
+		}
+		if counters == "" {
+			if counters, err = pamCountersFile(); err != nil {
+				return err
+			}
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+
+		a, err := userAgent(u)
+		if err != nil {
+			return &exitError{verifyFailed, err}
+		}
+
+		body, err := readAuthfile(authfile, u)
+		if err != nil {
+			return err
+		}
+
+		prompt := fmt.Sprintf("Touch your security key to authenticate as %s", username)
+		return u2fVerify(a, authfile, body, appID, username, counters, timeout, os.Stdout, prompt)
+	},
+}
+
+// readAuthfile reads a mapping file. We are probably root, reading a file
+// the user controls, so we don't follow a symlink to it, and require that
+// it is a regular file belonging to the user or root which nobody else can
+// write
+func readAuthfile(file string, u *user.User) ([]byte, error) {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// O_NONBLOCK stops us hanging on a FIFO
+	f, err := os.OpenFile(file, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Opening %s", file)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	switch {
+	case !ok || !fi.Mode().IsRegular():
+		return nil, errors.Errorf("%s is not a regular file", file)
+	case int(st.Uid) != uid && st.Uid != 0:
+		return nil, errors.Errorf("%s belongs to neither %s nor root", file, u.Username)
+	case fi.Mode().Perm()&0022 != 0:
+		return nil, errors.Errorf("%s is writable by other users", file)
+	}
+
+	body, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %s", file)
+	}
+	return body, nil
+}
+
+// pamCountersFile returns the default counters file. When run as root
+// it is system wide, as root's state directory may not be available
+func pamCountersFile() (string, error) {
+	if os.Geteuid() != 0 {
+		return lib.U2FCountersFile()
+	}
+
+	if err := os.MkdirAll(path.Dir(systemCountersFile), 0700); err != nil {
+		return "", err
+	}
+	return systemCountersFile, nil
+}
+
+// userAgent connects to u's agent
+func userAgent(u *user.User) (agent.Agent, error) {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []string{os.Getenv("SSH_AUTH_SOCK")}
+	candidates = append(candidates, ancestorAuthSocks()...)
+
+	for _, sock := range candidates {
+		if sock == "" {
+			continue
+		}
+
+		fi, err := os.Stat(sock)
+		if err != nil {
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != uid {
+			continue
+		}
+
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			continue
+		}
+		return agent.NewClient(conn), nil
+	}
+	return nil, errors.Errorf("Unable to find an agent for %s", u.Username)
+}
+
+// ancestorAuthSocks returns SSH_AUTH_SOCK from the environment of each of
+// our ancestor processes, nearest first
+func ancestorAuthSocks() (socks []string) {
+	pid := os.Getppid()
+	for pid > 1 {
+		if environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", pid)); err == nil {
+			for _, kv := range bytes.Split(environ, []byte{0}) {
+				if bytes.HasPrefix(kv, []byte("SSH_AUTH_SOCK=")) {
+					socks = append(socks, string(kv[len("SSH_AUTH_SOCK="):]))
+				}
+			}
+		}
+
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			break
+		}
+
+		// pid (comm) state ppid ...; comm may contain spaces
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 {
+			break
+		}
+		if pid, err = strconv.Atoi(fields[1]); err != nil {
+			break
+		}
+	}
+	return socks
+}
+
+func init() {
+	rootCmd.AddCommand(pamU2FCmd)
+	pamU2FCmd.Flags().String("origin", "", "Origin keys were registered for (default pam://$HOSTNAME)")
+	pamU2FCmd.Flags().String("appid", "", "AppID keys were registered for (default the origin)")
+	pamU2FCmd.Flags().String("authfile", "", "Mapping file (default ~/.config/Yubico/u2f_keys of the user)")
+	pamU2FCmd.Flags().String("counters", "", "File to record signature counters in (default "+systemCountersFile+" when run as root)")
+	pamU2FCmd.Flags().Duration("timeout", 30*time.Second, "How long to wait for a touch")
+}
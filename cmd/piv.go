@@ -0,0 +1,506 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/erincandescent/cardkit/protocol"
+	"github.com/erincandescent/ssh-emissary/pivagent"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// pivCmd represents the piv command
+var pivCmd = &cobra.Command{
+	Use:   "piv",
+	Short: "Manage PIV smartcards",
+	Long: `Manage keys, certificates and secrets on a PIV smartcard.
+
+The --transport flag uses the same syntax as the piv backend configuration`,
+}
+
+// openPIV opens the card named by the --transport flag, locks it and
+// selects the PIV application. The caller must unlock the card
+func openPIV(cmd *cobra.Command) (*protocol.Card, error) {
+	transport, err := cmd.Flags().GetString("transport")
+	if err != nil {
+		return nil, err
+	}
+
+	card, err := pivagent.OpenCard(transport)
+	if err != nil {
+		return nil, errors.Wrap(err, "Opening card")
+	}
+
+	if err := card.Lock(); err != nil {
+		return nil, errors.Wrap(err, "Error locking card")
+	}
+
+	if err := piv.SelectApp(card); err != nil {
+		card.Unlock()
+		return nil, errors.Wrap(err, "Error selecting PIV app")
+	}
+	return card, nil
+}
+
+// stdinLines reads the management keys given on standard input, one per
+// line
+var stdinLines = bufio.NewReader(os.Stdin)
+
+// readSecretLine reads a line of standard input
+func readSecretLine() ([]byte, error) {
+	line, err := stdinLines.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+	return []byte(line), nil
+}
+
+// readManagementKey reads the current management key, so that it never
+// appears on the command line. With --default-management-key, the PIV
+// default key is used; with --stdin, it is the first line of standard
+// input; otherwise it is asked for through pinentry. An empty key is the
+// default key
+func readManagementKey(cmd *cobra.Command) ([]byte, error) {
+	if useDefault, _ := cmd.Flags().GetBool("default-management-key"); useDefault {
+		return piv.DefaultManagementKey, nil
+	}
+
+	var s []byte
+	if fromStdin, _ := cmd.Flags().GetBool("stdin"); fromStdin {
+		line, err := readSecretLine()
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading management key")
+		}
+		s = line
+	} else {
+		var prompt pivagent.PinPrompt
+		defer prompt.Close()
+
+		key, err := prompt.GetSecret("Enter the card's management key in hex, or nothing for the default key", "Management key:")
+		if err != nil {
+			return nil, err
+		}
+		s = key
+	}
+
+	hexKey := strings.TrimSpace(string(s))
+	if hexKey == "" {
+		return piv.DefaultManagementKey, nil
+	}
+
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding management key")
+	}
+	return key, nil
+}
+
+func authenticateManagementKey(card *protocol.Card, key []byte) error {
+	if err := piv.AuthenticateManagementKey(card, key); err != nil {
+		return errors.Wrap(err, "Authenticating with management key")
+	}
+	return nil
+}
+
+func printAuthorizedKey(pub crypto.PublicKey, comment string) error {
+	sshkey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return errors.Wrap(err, "Converting to ssh key")
+	}
+
+	line := bytes.TrimSpace(ssh.MarshalAuthorizedKey(sshkey))
+	if comment != "" {
+		fmt.Printf("%s %s\n", line, comment)
+	} else {
+		fmt.Printf("%s\n", line)
+	}
+	return nil
+}
+
+var pivGenerateCmd = &cobra.Command{
+	Use:   "generate <slot>",
+	Short: "Generate a key in a slot",
+	Long: `Generates a new key in the given slot and stores a self-signed
+certificate for it, so that the piv backend will list it. Only the slots the
+backend lists, 9a (authentication) and 9e (card-authentication), are allowed.
+
+The public key is printed in authorized_keys format.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := pivagent.ParseSlot(args[0])
+		if err != nil {
+			return err
+		}
+
+		listed := false
+		for _, l := range pivagent.ListedSlots {
+			if id == l {
+				listed = true
+			}
+		}
+		if !listed {
+			return errors.Errorf("The piv backend doesn't list keys in the %s slot; use 9a or 9e", id.GetInfo().Name)
+		}
+
+		algName, err := cmd.Flags().GetString("algorithm")
+		if err != nil {
+			return err
+		}
+
+		alg, err := pivagent.ParseAlgorithm(algName)
+		if err != nil {
+			return err
+		}
+
+		subject, err := cmd.Flags().GetString("subject")
+		if err != nil {
+			return err
+		}
+
+		key, err := readManagementKey(cmd)
+		if err != nil {
+			return err
+		}
+
+		card, err := openPIV(cmd)
+		if err != nil {
+			return err
+		}
+		defer card.Unlock()
+
+		if err := authenticateManagementKey(card, key); err != nil {
+			return err
+		}
+
+		pub, err := piv.GenerateKey(card, id, alg)
+		if err != nil {
+			return errors.Wrap(err, "Generating key")
+		}
+
+		var prompt pivagent.PinPrompt
+		defer prompt.Close()
+
+		desc := fmt.Sprintf("Signing certificate for %s key", id.GetInfo().Name)
+		if err := prompt.Login(card, desc); err != nil {
+			return err
+		}
+
+		der, err := pivagent.SelfSign(card, id, pub, subject)
+		if err != nil {
+			return err
+		}
+
+		if err := piv.PutCertificate(card, id, der); err != nil {
+			return errors.Wrap(err, "Storing certificate")
+		}
+
+		return printAuthorizedKey(pub, subject)
+	},
+}
+
+var pivImportCertCmd = &cobra.Command{
+	Use:   "import-cert <slot> <file>",
+	Short: "Store a certificate in a slot",
+	Long: `Stores a PEM or DER encoded certificate in the given slot.
+
+The certificate must match the key already in the slot`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := pivagent.ParseSlot(args[0])
+		if err != nil {
+			return err
+		}
+
+		der, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return errors.Wrapf(err, "Reading %s", args[1])
+		}
+
+		if block, _ := pem.Decode(der); block != nil {
+			if block.Type != "CERTIFICATE" {
+				return errors.Errorf("Expected CERTIFICATE, found %s", block.Type)
+			}
+			der = block.Bytes
+		}
+
+		if _, err := x509.ParseCertificate(der); err != nil {
+			return errors.Wrap(err, "Parsing certificate")
+		}
+
+		key, err := readManagementKey(cmd)
+		if err != nil {
+			return err
+		}
+
+		card, err := openPIV(cmd)
+		if err != nil {
+			return err
+		}
+		defer card.Unlock()
+
+		if err := authenticateManagementKey(card, key); err != nil {
+			return err
+		}
+
+		if err := piv.PutCertificate(card, id, der); err != nil {
+			return errors.Wrap(err, "Storing certificate")
+		}
+		return nil
+	},
+}
+
+var pivPubkeyCmd = &cobra.Command{
+	Use:   "pubkey <slot>",
+	Short: "Print the public key in a slot",
+	Long:  `Prints the public key of the certificate in a slot in authorized_keys format`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := pivagent.ParseSlot(args[0])
+		if err != nil {
+			return err
+		}
+
+		card, err := openPIV(cmd)
+		if err != nil {
+			return err
+		}
+		defer card.Unlock()
+
+		cert, err := piv.GetCertificate(card, id)
+		if err != nil {
+			return errors.Wrapf(err, "Error getting %s key", id.GetInfo().Name)
+		}
+
+		x509cert, err := cert.ParseX509Certificate()
+		if err != nil {
+			return errors.Wrapf(err, "Error parsing %s key", id.GetInfo().Name)
+		}
+
+		return printAuthorizedKey(x509cert.PublicKey, x509cert.Subject.CommonName)
+	},
+}
+
+var pivAttestCmd = &cobra.Command{
+	Use:   "attest <slot>",
+	Short: "Verify that the key in a slot was generated on the card",
+	Long: `Fetches the YubiKey attestation certificate for a slot and verifies it
+against the card's attestation intermediate and the roots given by --roots
+(for example, the Yubico PIV attestation CA).
+
+Prints the card serial, firmware version and the key's PIN and touch policies.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := pivagent.ParseSlot(args[0])
+		if err != nil {
+			return err
+		}
+
+		rootsPath, err := cmd.Flags().GetString("roots")
+		if err != nil {
+			return err
+		}
+
+		roots, err := pivagent.LoadAttestationRoots(rootsPath)
+		if err != nil {
+			return err
+		}
+
+		card, err := openPIV(cmd)
+		if err != nil {
+			return err
+		}
+		defer card.Unlock()
+
+		a, err := pivagent.Attest(card, id, roots)
+		if err != nil {
+			return errors.Wrapf(err, "Attesting %s key", id.GetInfo().Name)
+		}
+
+		fmt.Printf("Slot:         %s\n", id.GetInfo().Name)
+		fmt.Printf("Serial:       %s\n", a.Serial)
+		fmt.Printf("Firmware:     %s\n", a.Firmware)
+		fmt.Printf("PIN policy:   %s\n", a.PINPolicy)
+		fmt.Printf("Touch policy: %s\n", a.TouchPolicy)
+		return printAuthorizedKey(a.Certificate.PublicKey, "")
+	},
+}
+
+// changeReference changes the PIN or PUK, prompting for the old and new values
+func changeReference(cmd *cobra.Command, ref piv.ReferenceID, name string) error {
+	card, err := openPIV(cmd)
+	if err != nil {
+		return err
+	}
+	defer card.Unlock()
+
+	var prompt pivagent.PinPrompt
+	defer prompt.Close()
+
+	old, err := prompt.GetSecret(fmt.Sprintf("Changing the %s", name), "Current "+name+":")
+	if err != nil {
+		return err
+	}
+
+	newSecret, err := prompt.GetSecret(fmt.Sprintf("Changing the %s", name), "New "+name+":")
+	if err != nil {
+		return err
+	}
+
+	confirm, err := prompt.GetSecret(fmt.Sprintf("Changing the %s", name), "Repeat "+name+":")
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(newSecret, confirm) {
+		return errors.Errorf("New %ss do not match", name)
+	}
+
+	err = piv.ChangeReference(card, ref, old, newSecret)
+	if protocol.PinAttempts(err) > 0 {
+		return errors.Errorf("Incorrect %s, %d attempts remaining", name, protocol.PinAttempts(err))
+	} else if err != nil {
+		return errors.Wrapf(err, "Changing %s", name)
+	}
+	return nil
+}
+
+var pivChangePinCmd = &cobra.Command{
+	Use:   "change-pin",
+	Short: "Change the PIN",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return changeReference(cmd, piv.ApplicationPIN, "PIN")
+	},
+}
+
+var pivChangePukCmd = &cobra.Command{
+	Use:   "change-puk",
+	Short: "Change the PIN unblocking key",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return changeReference(cmd, piv.PINUnblockingKey, "PUK")
+	},
+}
+
+var pivChangeManagementKeyCmd = &cobra.Command{
+	Use:   "change-management-key",
+	Short: "Change the management key",
+	Long: `Changes the management key. The current and new keys are given in
+hex, through pinentry or, with --stdin, on standard input: the current key on
+the first line and the new key on the second`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := readManagementKey(cmd)
+		if err != nil {
+			return err
+		}
+
+		newKey, err := readNewManagementKey(cmd)
+		if err != nil {
+			return err
+		}
+
+		card, err := openPIV(cmd)
+		if err != nil {
+			return err
+		}
+		defer card.Unlock()
+
+		if err := authenticateManagementKey(card, key); err != nil {
+			return err
+		}
+
+		if err := piv.SetManagementKey(card, newKey); err != nil {
+			return errors.Wrap(err, "Changing management key")
+		}
+		return nil
+	},
+}
+
+// readNewManagementKey reads the new management key from standard input
+// if --stdin is given, or otherwise prompts for it twice, so that it never
+// appears on the command line
+func readNewManagementKey(cmd *cobra.Command) ([]byte, error) {
+	var s []byte
+	if fromStdin, _ := cmd.Flags().GetBool("stdin"); fromStdin {
+		line, err := readSecretLine()
+		if err != nil {
+			return nil, errors.Wrap(err, "Reading new management key")
+		}
+		s = line
+	} else {
+		var prompt pivagent.PinPrompt
+		defer prompt.Close()
+
+		desc := "Changing the management key"
+		newKey, err := prompt.GetSecret(desc, "New management key:")
+		if err != nil {
+			return nil, err
+		}
+
+		confirm, err := prompt.GetSecret(desc, "Repeat management key:")
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(newKey, confirm) {
+			return nil, errors.New("New management keys do not match")
+		}
+		s = newKey
+	}
+
+	newKey, err := hex.DecodeString(strings.TrimSpace(string(s)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Decoding new management key")
+	}
+	return newKey, nil
+}
+
+func init() {
+	rootCmd.AddCommand(pivCmd)
+	pivCmd.PersistentFlags().String("transport", "", "Card transport, formatted as <name> or <name>:<params>")
+	pivCmd.PersistentFlags().Bool("default-management-key", false, "Use the PIV default management key instead of asking for it")
+	pivCmd.PersistentFlags().Bool("stdin", false, "Read management keys from standard input, one per line, instead of through pinentry")
+	pivCmd.MarkPersistentFlagRequired("transport")
+
+	pivCmd.AddCommand(pivGenerateCmd)
+	pivGenerateCmd.Flags().String("algorithm", "p256", "Key algorithm (p256, p384 or rsa2048)")
+	pivGenerateCmd.Flags().String("subject", "SSH key", "Common name of the self-signed certificate")
+
+	pivCmd.AddCommand(pivImportCertCmd)
+	pivCmd.AddCommand(pivPubkeyCmd)
+
+	pivCmd.AddCommand(pivAttestCmd)
+	pivAttestCmd.Flags().String("roots", "", "PEM file of trusted attestation roots")
+	pivAttestCmd.MarkFlagRequired("roots")
+
+	pivCmd.AddCommand(pivChangePinCmd)
+	pivCmd.AddCommand(pivChangePukCmd)
+	pivCmd.AddCommand(pivChangeManagementKeyCmd)
+}
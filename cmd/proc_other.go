@@ -0,0 +1,42 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// processExecutable returns the path of the executable pid is running,
+// as reported by ps
+func processExecutable(pid int) (string, error) {
+	out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "comm=").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "Examining process %d", pid)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// peerPid is only implemented on Linux
+func peerPid(conn net.Conn) (int, error) {
+	return 0, errors.New("Peer credentials are not supported on this platform")
+}
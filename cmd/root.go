@@ -37,10 +37,23 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
+		if ee, ok := err.(*exitError); ok {
+			os.Exit(ee.code)
+		}
 		os.Exit(1)
 	}
 }
 
+// exitError is returned by commands which exit with a particular status
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
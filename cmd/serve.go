@@ -18,88 +18,304 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 
 	"github.com/erincandescent/ssh-emissary/emissary"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	sshagent "golang.org/x/crypto/ssh/agent"
 	tilde "gopkg.in/mattes/go-expand-tilde.v1"
 )
 
+// defaultIdleTimeout is how long a socket activated agent waits without
+// connections before exiting
+const defaultIdleTimeout = 30 * time.Minute
+
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Runs the agent in the foreground",
+	Long: `Runs the agent in the foreground, listening on --sock (by default
+$XDG_RUNTIME_DIR/ssh-emissary/agent.sock). A stale socket left by an agent
+which crashed is replaced.
+
+When started by systemd socket activation, the sockets passed are used
+instead, and the agent exits once it has had no connections for
+--idle-timeout (default 30m; 0 never exits). systemd is notified when the
+agent is ready, reloading and stopping. SIGHUP reloads the configuration.
+
+With --stdio, the agent protocol is spoken on standard input and output
+instead, for a single client, and the agent exits when its input is closed.
+This allows the proxy backend of another agent to run, for example,
+"ssh bastion ssh-emissary serve --stdio". The client is treated as
+forwarded.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+Listeners declared in the configuration file, for TLS and abstract unix
+sockets, are opened at startup in addition.
+
+On SIGTERM or SIGINT the agent stops accepting connections, waits up to
+--drain-timeout for requests in progress to finish, and closes its backends.`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		sockPath, err := cmd.Flags().GetString("sock")
 		if err != nil {
 			return err
 		}
 
-		listener, err := net.Listen("unix", sockPath)
+		idleTimeout, err := cmd.Flags().GetDuration("idle-timeout")
 		if err != nil {
 			return err
 		}
 
-		home, err := tilde.Home()
+		drainTimeout, err := cmd.Flags().GetDuration("drain-timeout")
 		if err != nil {
 			return err
 		}
 
-		configPath := path.Join(home, ".config", "ssh-emissary", "config.json")
-		f, err := os.Open(configPath)
+		if stdio, _ := cmd.Flags().GetBool("stdio"); stdio {
+			return serveStdio()
+		}
+
+		activated, err := lib.ListenFds()
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		conf, err := ioutil.ReadAll(f)
+		var listeners []net.Listener
+		if activated != nil {
+			for _, l := range activated {
+				checkActivatedSocket(l)
+				listeners = append(listeners, l)
+			}
+			if !cmd.Flags().Changed("idle-timeout") {
+				idleTimeout = defaultIdleTimeout
+			}
+		} else {
+			if sockPath == "" {
+				if sockPath, err = lib.DefaultSocket(); err != nil {
+					return err
+				}
+			}
+
+			l, err := listenPrivate(sockPath)
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, l)
+		}
+
+		extra, err := configuredListeners()
 		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
 			return err
 		}
+		for _, l := range extra {
+			listeners = append(listeners, l)
+		}
+
+		s := newServer(listeners, idleTimeout)
+		defer s.closeListeners()
+
+		// Register before loading and saying we are ready, so that
+		// signals sent meanwhile are handled once we start waiting
+		// rather than killing us
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(signals)
 
-		agent, err := emissary.Create(conf)
+		if err := s.load(); err != nil {
+			return err
+		}
+
+		readyFd, err := cmd.Flags().GetInt("ready-fd")
 		if err != nil {
 			return err
 		}
+		if readyFd != 0 {
+			// Tell the daemon command we are listening
+			ready := os.NewFile(uintptr(readyFd), "ready")
+			fmt.Fprintln(ready, sockPath)
+			ready.Close()
+		}
+		lib.SdNotify("READY=1")
+
+		idle := s.idleC()
+		s.start()
 
+	wait:
 		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				fmt.Printf("Error accepting: %s\n", err.Error())
-				os.Exit(1)
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					s.reload()
+					continue
+				}
+				log.Printf("Received %s, stopping", sig)
+				break wait
+
+			case <-idle:
+				log.Printf("Idle for %s, stopping", s.idleTimeout)
+				break wait
+
+			case err := <-s.failed:
+				log.Printf("Error accepting, stopping: %s", err)
+				break wait
 			}
-			go serveConnection(agent, conn)
 		}
+
+		lib.SdNotify("STOPPING=1")
+		s.shutdown(drainTimeout)
+		return nil
 	},
 }
 
-func serveConnection(agent sshagent.Agent, conn net.Conn) {
-	err := sshagent.ServeAgent(agent, conn)
+// stdioConn is the connection of serve --stdio
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+// serveStdio serves a single connection on standard input and output,
+// exiting when it is closed. The client is usually another host, so the
+// connection is treated as forwarded
+func serveStdio() error {
+	s := newServer(nil, 0)
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	err := sshagent.ServeAgent(lib.NewRemoteSessionAgent(s.agent.Agent), stdioConn{os.Stdin, os.Stdout})
 	if err != io.EOF {
-		fmt.Printf("Error serving connection: %s\n", err)
+		log.Printf("Error serving connection: %s", err)
 	}
+
+	s.shutdown(0)
+	return nil
 }
 
-func init() {
-	rootCmd.AddCommand(serveCmd)
-	serveCmd.Flags().String("sock", "", "Socket path to listen on")
+// listenUnix listens on a unix socket, replacing a stale socket left by
+// an agent which is no longer running
+func listenUnix(sockPath string) (net.Listener, error) {
+	l, err := net.Listen("unix", sockPath)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
 
-	// Here you will define your flags and configuration settings.
+	if conn, err := net.Dial("unix", sockPath); err == nil {
+		conn.Close()
+		return nil, errors.Errorf("An agent is already listening on %s", sockPath)
+	}
+
+	fi, err := os.Lstat(sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil, errors.Errorf("%s exists and is not a socket", sockPath)
+	}
+
+	log.Printf("Replacing stale socket %s", sockPath)
+	if err := os.Remove(sockPath); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", sockPath)
+}
+
+// listenPrivate listens on a unix socket only we may connect to, in a
+// directory nobody else may write to
+func listenPrivate(sockPath string) (net.Listener, error) {
+	warning, err := lib.MakePrivateDir(path.Dir(sockPath))
+	if err != nil {
+		return nil, errors.Wrap(err, "Refusing to listen in an insecure directory")
+	}
+	if warning != "" {
+		log.Printf("Warning: %s", warning)
+	}
+
+	// Make sure the socket is never accessible to others, even briefly
+	umask := syscall.Umask(0177)
+	l, err := listenUnix(sockPath)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// serveCmd.PersistentFlags().String("foo", "", "A help for foo")
+	if err := os.Chmod(sockPath, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// checkActivatedSocket warns if a socket passed by systemd is accessible
+// to other users. It is systemd's to manage, so we don't change it
+func checkActivatedSocket(l net.Listener) {
+	addr, ok := l.Addr().(*net.UnixAddr)
+	if !ok || addr.Name == "" || addr.Name[0] == '@' {
+		return
+	}
+
+	if warning, err := lib.CheckPrivateDir(path.Dir(addr.Name)); err != nil {
+		log.Printf("Warning: %s", err)
+	} else if warning != "" {
+		log.Printf("Warning: %s", warning)
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	if fi, err := os.Stat(addr.Name); err == nil && fi.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: %s is accessible by other users (mode %04o)", addr.Name, fi.Mode().Perm())
+	}
+}
+
+// configuredListeners creates the listeners declared in the configuration
+// file. They are only created at startup, not on reload
+func configuredListeners() ([]*emissary.Listener, error) {
+	conf, configPath, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listeners, err := emissary.CreateListeners(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Loading %s", configPath)
+	}
+	for _, l := range listeners {
+		log.Printf("Listening on %s", l.Addr())
+	}
+	return listeners, nil
+}
+
+// loadConfig reads the configuration file
+func loadConfig() ([]byte, string, error) {
+	home, err := tilde.Home()
+	if err != nil {
+		return nil, "", err
+	}
+
+	configPath := path.Join(home, ".config", "ssh-emissary", "config.json")
+	f, err := os.Open(configPath)
+	if err != nil {
+		return nil, configPath, err
+	}
+	defer f.Close()
+
+	conf, err := ioutil.ReadAll(f)
+	return conf, configPath, err
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().String("sock", "", "Socket path to listen on (default $XDG_RUNTIME_DIR/ssh-emissary/agent.sock)")
+	serveCmd.Flags().Bool("stdio", false, "Serve a single client on standard input and output")
+	serveCmd.Flags().Int("ready-fd", 0, "File descriptor to write the socket path to once listening")
+	serveCmd.Flags().Duration("idle-timeout", 0, "Exit after this long without connections (default 30m when socket activated)")
+	serveCmd.Flags().Duration("drain-timeout", 10*time.Second, "How long to wait for requests in progress when stopping")
 }
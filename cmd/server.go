@@ -0,0 +1,349 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/emissary"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// server holds the state of a running agent
+type server struct {
+	listeners []net.Listener
+	// failed receives an accept error which stops the server
+	failed chan error
+
+	mu    sync.Mutex
+	agent *loadedAgent
+	// agents holds every agent not yet closed: the current one, and those
+	// replaced by a reload which still have connections
+	agents map[*loadedAgent]bool
+
+	conns    map[*trackedConn]bool
+	wg       sync.WaitGroup
+	stopping bool
+
+	// Once there have been no connections for idleTimeout, idle fires
+	idleTimeout time.Duration
+	idle        *time.Timer
+}
+
+func newServer(listeners []net.Listener, idleTimeout time.Duration) *server {
+	return &server{
+		listeners:   listeners,
+		failed:      make(chan error, len(listeners)),
+		agents:      make(map[*loadedAgent]bool),
+		conns:       make(map[*trackedConn]bool),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// loadedAgent is an agent loaded from the configuration, with a count of
+// the connections using it
+type loadedAgent struct {
+	sshagent.Agent
+	conns int
+}
+
+// load creates the agent from the configuration file. The agent it
+// replaces is closed once its connections have finished
+func (self *server) load() error {
+	conf, configPath, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	agent, err := emissary.Create(conf)
+	if err != nil {
+		return errors.Wrapf(err, "Loading %s", configPath)
+	}
+
+	self.mu.Lock()
+	old := self.agent
+	self.agent = &loadedAgent{Agent: agent}
+	self.agents[self.agent] = true
+	if old != nil && old.conns == 0 {
+		delete(self.agents, old)
+	} else {
+		old = nil
+	}
+	self.mu.Unlock()
+
+	if old != nil {
+		closeAgent(old)
+	}
+	return nil
+}
+
+// release drops a connection's use of agent, closing it if it has been
+// replaced and this was its last connection
+func (self *server) release(agent *loadedAgent) {
+	self.mu.Lock()
+	agent.conns--
+	unused := agent != self.agent && agent.conns == 0 && self.agents[agent]
+	if unused {
+		delete(self.agents, agent)
+	}
+	self.mu.Unlock()
+
+	if unused {
+		closeAgent(agent)
+	}
+}
+
+func closeAgent(agent *loadedAgent) {
+	if c, ok := agent.Agent.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Error closing backends: %s", err)
+		}
+	}
+}
+
+// reload reloads the configuration, keeping the current agent if it fails.
+// Connections already open continue with the agent they started with
+func (self *server) reload() {
+	lib.SdNotify("RELOADING=1")
+	if err := self.load(); err != nil {
+		log.Printf("Error reloading configuration: %s", err)
+	} else {
+		log.Print("Reloaded configuration")
+	}
+	lib.SdNotify("READY=1")
+}
+
+// idleC returns a channel which receives once we have been idle for
+// idleTimeout, or nil if we never go idle
+func (self *server) idleC() <-chan time.Time {
+	if self.idleTimeout <= 0 {
+		return nil
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.idle = time.NewTimer(self.idleTimeout)
+	return self.idle.C
+}
+
+func (self *server) start() {
+	for _, l := range self.listeners {
+		go self.accept(l)
+	}
+}
+
+func (self *server) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			self.mu.Lock()
+			stopping := self.stopping
+			self.mu.Unlock()
+			if stopping {
+				return
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("Error accepting: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			self.failed <- err
+			return
+		}
+
+		tc := &trackedConn{Conn: conn}
+
+		self.mu.Lock()
+		if self.stopping {
+			self.mu.Unlock()
+			conn.Close()
+			return
+		}
+		agent := self.agent
+		agent.conns++
+		self.conns[tc] = true
+		self.wg.Add(1)
+		if self.idle != nil {
+			self.idle.Stop()
+		}
+		self.mu.Unlock()
+
+		go func() {
+			self.serve(listener, agent.Agent, tc)
+			self.release(agent)
+
+			self.mu.Lock()
+			delete(self.conns, tc)
+			if len(self.conns) == 0 && self.idle != nil && !self.stopping {
+				self.idle.Reset(self.idleTimeout)
+			}
+			self.mu.Unlock()
+			self.wg.Done()
+		}()
+	}
+}
+
+func (self *server) closeListeners() {
+	self.mu.Lock()
+	self.stopping = true
+	self.mu.Unlock()
+
+	for _, l := range self.listeners {
+		// This unlinks sockets we created
+		l.Close()
+	}
+}
+
+// shutdown stops accepting connections, closes idle connections, waits up
+// to timeout for requests in progress to finish, and closes the backends
+func (self *server) shutdown(timeout time.Duration) {
+	self.closeListeners()
+
+	self.mu.Lock()
+	for c := range self.conns {
+		c.closeWhenIdle()
+	}
+	self.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		self.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Requests still in progress after %s; closing their connections", timeout)
+		self.mu.Lock()
+		for c := range self.conns {
+			c.Close()
+		}
+		self.mu.Unlock()
+	}
+
+	self.mu.Lock()
+	agents := self.agents
+	self.agents = make(map[*loadedAgent]bool)
+	self.mu.Unlock()
+
+	for a := range agents {
+		closeAgent(a)
+	}
+}
+
+// trackedConn is a connection which knows whether a request is in
+// progress, so that idle connections can be closed at shutdown while
+// requests in progress are allowed to finish
+type trackedConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	busy    bool
+	replied bool
+	closing bool
+}
+
+// Read marks the connection busy once a request starts to arrive. A reply
+// may take several writes, so the request is only complete when the client
+// is next read from
+func (c *trackedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.replied {
+		c.replied = false
+		c.busy = false
+		if c.closing {
+			c.Conn.Close()
+		}
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.busy = true
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Write sends (part of) a reply to the request in progress
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	c.mu.Lock()
+	c.replied = true
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *trackedConn) isClosing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closing
+}
+
+func (c *trackedConn) closeWhenIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closing = true
+	if !c.busy {
+		c.Conn.Close()
+	}
+}
+
+// serve serves a connection accepted from listener, first checking the
+// client of listeners declared in the configuration
+func (self *server) serve(listener net.Listener, agent sshagent.Agent, tc *trackedConn) {
+	el, ok := listener.(*emissary.Listener)
+	if !ok {
+		serveConnection(lib.NewSessionAgent(agent), tc)
+		return
+	}
+
+	agent, err := el.Authorize(tc.Conn, agent)
+	if err != nil {
+		log.Printf("Refusing connection from %s: %s", tc.RemoteAddr(), err)
+		tc.Close()
+		return
+	}
+
+	if el.Remote() {
+		serveConnection(lib.NewRemoteSessionAgent(agent), tc)
+	} else {
+		serveConnection(lib.NewSessionAgent(agent), tc)
+	}
+}
+
+func serveConnection(agent sshagent.Agent, conn net.Conn) {
+	defer conn.Close()
+
+	err := sshagent.ServeAgent(agent, conn)
+	if tc, ok := conn.(*trackedConn); ok && tc.isClosing() {
+		// We closed it
+		return
+	}
+	if err != io.EOF {
+		log.Printf("Error serving connection: %s", err)
+	}
+}
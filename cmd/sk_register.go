@@ -0,0 +1,109 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fagent"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// skRegisterCmd represents the sk-register command
+var skRegisterCmd = &cobra.Command{
+	Use:   "sk-register",
+	Short: "Register a U2F token as an OpenSSH security key",
+	Long: `Registers a U2F token connected to the agent as an OpenSSH
+sk-ecdsa-sha2-nistp256@openssh.com or sk-ssh-ed25519@openssh.com key. The key
+handle is stored by the agent, which will then offer the key to ssh.
+
+FIDO2 devices can also create resident keys, which are stored on the device
+and can be listed by any agent with resident_keys enabled.
+
+The public key is printed in authorized_keys format.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		application, err := cmd.Flags().GetString("application")
+		if err != nil {
+			return err
+		}
+
+		comment, err := cmd.Flags().GetString("comment")
+		if err != nil {
+			return err
+		}
+
+		algorithm, err := cmd.Flags().GetString("algorithm")
+		if err != nil {
+			return err
+		}
+
+		resident, err := cmd.Flags().GetBool("resident")
+		if err != nil {
+			return err
+		}
+
+		a, err := lib.ConnectAgent()
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Registering, touch a key...")
+
+		req := u2fagent.SKRegisterRequest{
+			Application: application,
+			Comment:     comment,
+			Algorithm:   algorithm,
+			Resident:    resident,
+		}
+		res, err := lib.CallExtension(a, u2fagent.SKRegisterExtension, ssh.Marshal(&req))
+		if err == agent.ErrExtensionUnsupported {
+			return errors.New("Agent does not support security key registration")
+		} else if err != nil {
+			return errors.Wrap(err, "Registering key")
+		}
+
+		var resp u2fagent.SKRegisterResponse
+		if err := ssh.Unmarshal(res, &resp); err != nil {
+			return errors.Wrap(err, "Parsing response")
+		}
+
+		pub, err := ssh.ParsePublicKey(resp.PublicKey)
+		if err != nil {
+			return errors.Wrap(err, "Parsing public key")
+		}
+
+		line := bytes.TrimSpace(ssh.MarshalAuthorizedKey(pub))
+		if comment != "" {
+			fmt.Printf("%s %s\n", line, comment)
+		} else {
+			fmt.Printf("%s\n", line)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(skRegisterCmd)
+	skRegisterCmd.Flags().String("application", "ssh:", "OpenSSH application string")
+	skRegisterCmd.Flags().String("comment", "", "Comment for the key")
+	skRegisterCmd.Flags().String("algorithm", "ecdsa", "Key algorithm (ecdsa or ed25519; ed25519 needs a FIDO2 device)")
+	skRegisterCmd.Flags().Bool("resident", false, "Store the key on the device (needs a FIDO2 device)")
+}
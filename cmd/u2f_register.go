@@ -17,11 +17,9 @@ package cmd
 import (
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"time"
 
@@ -37,8 +35,38 @@ import (
 var u2fRegisterCmd = &cobra.Command{
 	Use:   "u2f-register",
 	Short: "Register a U2F token",
-	Long:  `Register a new U2F token for use as an authorized key on this machine`,
+	Long: `Register a new U2F token for use as an authorized key on this machine.
+
+The registration is printed, or appended to the mapping file given by
+--output. The format is one of:
+  emissary        user:publickey,keyhandle, as read by u2f-auth
+  pam_u2f         the u2f_keys format of pam_u2f 1.1 and later
+  pam_u2f-legacy  the u2f_keys format of earlier pam_u2f versions
+
+For pam_u2f, the origin and AppID must match those given to the PAM module.
+Both default to pam://$HOSTNAME, as they do in pam_u2f.`,
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		appID, err := u2fAppID(cmd)
+		if err != nil {
+			return err
+		}
+
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return err
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			return err
+		}
+
 		a, err := lib.ConnectAgent()
 		if err != nil {
 			return err
@@ -57,44 +85,104 @@ var u2fRegisterCmd = &cobra.Command{
 		}
 
 		if len(u2fkeys) == 0 {
-			return errors.New("No U2F keys connected to agent\n")
+			return errors.New("No U2F keys connected to agent")
 		}
 
-		fmt.Println("Registering, touch a key...")
+		fmt.Fprintln(os.Stderr, "Registering, touch a key...")
 
-		appId := sha256.Sum256([]byte("urn:example"))
+		appIdHash := sha256.Sum256([]byte(appID))
 
-		for {
-			for i := 0; i < len(u2fkeys); i++ {
-				dev := u2fproxy.NewProxyDevice(a, *keys[i])
-				tok := u2ftoken.NewToken(dev)
+		regReq := u2ftoken.RegisterRequest{}
+		regReq.Application = appIdHash[:]
+		regReq.Challenge = make([]byte, 32)
+		io.ReadFull(rand.Reader, regReq.Challenge)
 
-				regReq := u2ftoken.RegisterRequest{}
-				regReq.Application = appId[:]
-				regReq.Challenge = make([]byte, 32)
-				io.ReadFull(rand.Reader, regReq.Challenge)
-
-				res, err := tok.Register(regReq)
-				if err == u2ftoken.ErrPresenceRequired {
-					continue
-				} else if err != nil {
-					log.Fatal(err)
-				}
+		res, err := register(a, u2fkeys, regReq)
+		if err != nil {
+			return err
+		}
 
-				pubKey := res[1:66]
-				khLen := res[66]
-				kh := res[67 : 67+khLen]
+		// 0x05 | public key (65) | key handle length | key handle | ...
+		if len(res) < 67 || len(res) < 67+int(res[66]) {
+			return errors.New("Short registration response")
+		}
+		cred := lib.U2FCredential{
+			PublicKey: res[1:66],
+			KeyHandle: res[67 : 67+int(res[66])],
+		}
 
-				enc := base64.RawStdEncoding
-				fmt.Printf("%s:%s,%s\n", os.Getenv("USER"), enc.EncodeToString(pubKey), enc.EncodeToString(kh))
-				return nil
+		if output != "" {
+			if err := lib.AppendU2FCredential(output, format, user, cred); err != nil {
+				return err
 			}
+			fmt.Fprintf(os.Stderr, "Added registration for %s to %s\n", user, output)
+			return nil
+		}
 
-			time.Sleep(200 * time.Millisecond)
+		line, err := lib.FormatU2FCredential(format, cred)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("%s:%s\n", user, line)
+		return nil
 	},
 }
 
+// u2fAppID returns the AppID given by the --origin and --appid flags,
+// defaulting as pam_u2f does
+func u2fAppID(cmd *cobra.Command) (string, error) {
+	origin, err := cmd.Flags().GetString("origin")
+	if err != nil {
+		return "", err
+	}
+
+	appID, err := cmd.Flags().GetString("appid")
+	if err != nil {
+		return "", err
+	}
+
+	if origin == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		origin = "pam://" + hostname
+	}
+	if appID == "" {
+		appID = origin
+	}
+	return appID, nil
+}
+
+// register registers with whichever device the user touches
+func register(a agent.Agent, u2fkeys []*agent.Key, regReq u2ftoken.RegisterRequest) ([]byte, error) {
+	// Let the agent wait for a touch on any device if it can
+	res, err := u2ftoken.NewToken(u2fproxy.NewAnyDevice(a, 0)).Register(regReq)
+	if err != agent.ErrExtensionUnsupported {
+		return res, err
+	}
+
+	for {
+		for i := 0; i < len(u2fkeys); i++ {
+			dev := u2fproxy.NewProxyDevice(a, *u2fkeys[i], 0)
+			tok := u2ftoken.NewToken(dev)
+
+			res, err := tok.Register(regReq)
+			if err == u2ftoken.ErrPresenceRequired {
+				continue
+			}
+			return res, err
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(u2fRegisterCmd)
+	u2fRegisterCmd.Flags().String("origin", "", "Origin to register for (default pam://$HOSTNAME)")
+	u2fRegisterCmd.Flags().String("appid", "", "AppID to register for (default the origin)")
+	u2fRegisterCmd.Flags().String("user", os.Getenv("USER"), "User name to register for")
+	u2fRegisterCmd.Flags().StringP("output", "o", "", "Mapping file to append the registration to")
+	u2fRegisterCmd.Flags().String("format", lib.U2FKeysEmissary, "Output format (emissary, pam_u2f or pam_u2f-legacy)")
 }
@@ -0,0 +1,232 @@
+// Copyright © 2018 Erin Shepherd <erin.shepherd@e43.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fproxy"
+	"github.com/flynn/u2f/u2ftoken"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// verifyFailed is the exit status of u2f-verify when the user doesn't
+// authenticate, as opposed to 1 when something goes wrong
+const verifyFailed = 2
+
+// u2fVerifyCmd represents the u2f-verify command
+var u2fVerifyCmd = &cobra.Command{
+	Use:     "u2f-verify <mapping file>",
+	Aliases: []string{"u2f-auth"},
+	Short:   "Authenticate a user with a U2F token",
+	Long: `Authenticates a user with a U2F token connected to the agent, against the
+keys registered for them in a mapping file. The file may be in any of the
+formats written by u2f-register, including pam_u2f's u2f_keys format.
+
+Signature counters are recorded, and authentication fails if a key's
+counter doesn't increase, as that suggests the token has been cloned.
+
+Exits with status 0 if the user authenticated, 2 if they did not, and 1 if
+something else went wrong.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		appID, err := u2fAppID(cmd)
+		if err != nil {
+			return err
+		}
+
+		user, err := cmd.Flags().GetString("user")
+		if err != nil {
+			return err
+		}
+
+		counters, err := cmd.Flags().GetString("counters")
+		if err != nil {
+			return err
+		}
+		if counters == "" {
+			if counters, err = lib.U2FCountersFile(); err != nil {
+				return err
+			}
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			return err
+		}
+
+		a, err := lib.ConnectAgent()
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return errors.Wrapf(err, "Reading %s", args[0])
+		}
+
+		return u2fVerify(a, args[0], body, appID, user, counters, timeout, os.Stderr, "Please touch your token...")
+	},
+}
+
+// u2fVerify authenticates user against the mapping file file, containing
+// body, returning an exitError with status verifyFailed if they don't. The
+// prompt is written to out once we have found a token
+func u2fVerify(a agent.Agent, file string, body []byte, appID, user, counters string, timeout time.Duration, out io.Writer, prompt string) error {
+	users, err := lib.ParseU2FKeys(body)
+	if err != nil {
+		return errors.Wrapf(err, "Parsing %s", file)
+	}
+
+	creds := users[user]
+	if len(creds) == 0 {
+		return &exitError{verifyFailed, errors.Errorf("No keys registered for %s", user)}
+	}
+
+	appIdHash := sha256.Sum256([]byte(appID))
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return err
+	}
+
+	token, cred, err := findU2FToken(a, appIdHash[:], challenge, creds, timeout)
+	if err != nil {
+		return err
+	} else if token == nil {
+		return &exitError{verifyFailed, errors.New("Unable to find any registered token")}
+	}
+
+	req := u2ftoken.AuthenticateRequest{
+		Challenge:   challenge,
+		Application: appIdHash[:],
+		KeyHandle:   cred.KeyHandle,
+	}
+
+	fmt.Fprintln(out, prompt)
+	var resp *u2ftoken.AuthenticateResponse
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err = token.Authenticate(req)
+		if err == u2ftoken.ErrPresenceRequired && time.Now().Before(deadline) {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		} else if err != nil {
+			return &exitError{verifyFailed, err}
+		}
+		break
+	}
+
+	if err := verifyU2FSignature(cred, appIdHash[:], challenge, resp); err != nil {
+		return &exitError{verifyFailed, err}
+	}
+
+	if err := lib.UpdateU2FCounter(counters, appID, cred.KeyHandle, resp.Counter); err != nil {
+		return &exitError{verifyFailed, err}
+	}
+	return nil
+}
+
+// findU2FToken finds a token connected to the agent holding one of creds.
+// Requests to it wait in the agent for up to timeout
+func findU2FToken(a agent.Agent, appIdHash, challenge []byte, creds []lib.U2FCredential, timeout time.Duration) (*u2ftoken.Token, lib.U2FCredential, error) {
+	keys, err := a.List()
+	if err != nil {
+		return nil, lib.U2FCredential{}, errors.Wrap(err, "Getting keys from agent")
+	}
+
+	// A token we can't talk to mustn't stop us finding another
+	var errs error
+	for _, key := range keys {
+		if key.Format != "u2f" {
+			continue
+		}
+
+		token := u2ftoken.NewToken(u2fproxy.NewProxyDevice(a, *key, timeout))
+		for _, cred := range creds {
+			err := token.CheckAuthenticate(u2ftoken.AuthenticateRequest{
+				Challenge:   challenge,
+				Application: appIdHash,
+				KeyHandle:   cred.KeyHandle,
+			})
+			if err == u2ftoken.ErrUnknownKeyHandle {
+				continue
+			} else if err != nil {
+				errs = multierr.Append(errs, errors.Wrapf(err, "Talking to %s", key.Comment))
+				break
+			}
+			return token, cred, nil
+		}
+	}
+	return nil, lib.U2FCredential{}, errs
+}
+
+// verifyU2FSignature checks an authentication response was signed by cred
+// with the user present
+func verifyU2FSignature(cred lib.U2FCredential, appIdHash, challenge []byte, resp *u2ftoken.AuthenticateResponse) error {
+	x, y := elliptic.Unmarshal(elliptic.P256(), cred.PublicKey)
+	if x == nil {
+		return errors.New("Error unmarshalling public key")
+	}
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	// user presence | counter (4) | signature
+	if len(resp.RawResponse) < 5 {
+		return errors.New("Short authentication response")
+	}
+	flags := resp.RawResponse[0]
+	if flags&0x01 == 0 {
+		return errors.New("User was not present")
+	}
+
+	baseString := append([]byte(nil), appIdHash...)
+	baseString = append(baseString, resp.RawResponse[:5]...)
+	baseString = append(baseString, challenge...)
+	digest := sha256.Sum256(baseString)
+
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(resp.Signature, &sig); err != nil {
+		return errors.Wrap(err, "Error unmarshalling signature")
+	}
+
+	if !ecdsa.Verify(&pubKey, digest[:], sig.R, sig.S) {
+		return errors.New("Error verifying signature")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(u2fVerifyCmd)
+	u2fVerifyCmd.Flags().String("origin", "", "Origin the key was registered for (default pam://$HOSTNAME)")
+	u2fVerifyCmd.Flags().String("appid", "", "AppID the key was registered for (default the origin)")
+	u2fVerifyCmd.Flags().String("user", os.Getenv("USER"), "User to authenticate")
+	u2fVerifyCmd.Flags().String("counters", "", "File to record signature counters in (default $XDG_STATE_HOME/ssh-emissary/u2f-counters.json)")
+	u2fVerifyCmd.Flags().Duration("timeout", 30*time.Second, "How long to wait for a touch")
+}
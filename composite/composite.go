@@ -3,8 +3,10 @@ package composite
 
 import (
 	"bytes"
+	"io"
 	"log"
 
+	"github.com/erincandescent/ssh-emissary/lib"
 	"github.com/pkg/errors"
 	"go.uber.org/multierr"
 	"golang.org/x/crypto/ssh"
@@ -21,7 +23,8 @@ type CompositeAgent struct {
 	keys   []knownKey
 }
 
-var _ agent.Agent = &CompositeAgent{}
+var _ agent.ExtendedAgent = &CompositeAgent{}
+var _ lib.SessionAgent = &CompositeAgent{}
 
 func New(agents []agent.Agent) *CompositeAgent {
 	return &CompositeAgent{
@@ -57,13 +60,21 @@ func (self *CompositeAgent) List() (keys []*agent.Key, err error) {
 }
 
 func (self *CompositeAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return self.SignWithFlags(key, data, 0)
+}
+
+func (self *CompositeAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return self.SignInSession(nil, key, data, flags)
+}
+
+func (self *CompositeAgent) SignInSession(s *lib.Session, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
 	fp := key.Marshal()
 
 	// Try searching for a key we know the subagent for
 	for _, k := range self.keys {
 		if bytes.Equal(k.fp, fp) {
 			log.Print("Signing through known agent")
-			s, err := k.agent.Sign(key, data)
+			s, err := lib.SignInSession(k.agent, s, key, data, flags)
 			log.Print("Signed ", err)
 			return s, err
 		}
@@ -72,7 +83,7 @@ func (self *CompositeAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature
 	log.Print("Trying every agent")
 	// Not found, just ask every agent
 	for _, agent := range self.agents {
-		sig, err := agent.Sign(key, data)
+		sig, err := lib.SignInSession(agent, s, key, data, flags)
 		if err != nil {
 			continue
 		}
@@ -86,6 +97,23 @@ func (self *CompositeAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature
 	return nil, errors.New("Key not found")
 }
 
+// Extension passes the request to each subagent in turn until one
+// supports it
+func (self *CompositeAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return self.ExtensionInSession(nil, extensionType, contents)
+}
+
+func (self *CompositeAgent) ExtensionInSession(s *lib.Session, extensionType string, contents []byte) ([]byte, error) {
+	for _, a := range self.agents {
+		res, err := lib.ExtensionInSession(a, s, extensionType, contents)
+		if err == agent.ErrExtensionUnsupported {
+			continue
+		}
+		return res, err
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
+
 func (self *CompositeAgent) Add(key agent.AddedKey) error {
 	var errs error
 	for _, agent := range self.agents {
@@ -154,6 +182,16 @@ func (self *CompositeAgent) Unlock(passphrase []byte) (errs error) {
 	return errs
 }
 
+// Close closes each subagent which holds resources
+func (self *CompositeAgent) Close() (errs error) {
+	for _, a := range self.agents {
+		if c, ok := a.(io.Closer); ok {
+			errs = multierr.Append(errs, c.Close())
+		}
+	}
+	return errs
+}
+
 func (self *CompositeAgent) Signers() ([]ssh.Signer, error) {
 	return nil, errors.New("Not implemented")
 }
@@ -0,0 +1,71 @@
+package ctap2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// COSE key types and curves
+const (
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// COSEKey is a COSE_Key public key
+type COSEKey struct {
+	KeyType   int    `cbor:"1,keyasint"`
+	Algorithm int    `cbor:"3,keyasint,omitempty"`
+	Curve     int    `cbor:"-1,keyasint,omitempty"`
+	X         []byte `cbor:"-2,keyasint,omitempty"`
+	Y         []byte `cbor:"-3,keyasint,omitempty"`
+}
+
+// PublicKey returns the key as an *ecdsa.PublicKey or ed25519.PublicKey
+func (k *COSEKey) PublicKey() (interface{}, error) {
+	switch {
+	case k.KeyType == coseKeyTypeEC2 && k.Curve == coseCurveP256:
+		if len(k.X) != 32 || len(k.Y) != 32 {
+			return nil, errors.New("ctap2: invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(k.X),
+			Y:     new(big.Int).SetBytes(k.Y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("ctap2: P-256 key not on curve")
+		}
+		return pub, nil
+
+	case k.KeyType == coseKeyTypeOKP && k.Curve == coseCurveEd25519:
+		if len(k.X) != ed25519.PublicKeySize {
+			return nil, errors.New("ctap2: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(k.X), nil
+	}
+	return nil, errors.Errorf("ctap2: unsupported key type %d curve %d", k.KeyType, k.Curve)
+}
+
+// ecdhKey converts an ECDSA key to the COSE form used for PIN key agreement
+func ecdhKey(pub *ecdsa.PublicKey) *COSEKey {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+
+	return &COSEKey{
+		KeyType: coseKeyTypeEC2,
+		// ECDH-ES+HKDF-256, as required by PIN protocol 1
+		Algorithm: -25,
+		Curve:     coseCurveP256,
+		X:         x,
+		Y:         y,
+	}
+}
@@ -0,0 +1,126 @@
+package ctap2
+
+import (
+	"github.com/pkg/errors"
+)
+
+// credentialManagement subcommands
+const (
+	credMgmtEnumerateRPsBegin         = 0x02
+	credMgmtEnumerateRPsGetNext       = 0x03
+	credMgmtEnumerateCredentialsBegin = 0x04
+	credMgmtEnumerateCredentialsNext  = 0x05
+)
+
+type credMgmtParams struct {
+	RPIDHash []byte `cbor:"1,keyasint,omitempty"`
+}
+
+type credMgmtRequest struct {
+	SubCommand  uint            `cbor:"1,keyasint"`
+	Params      *credMgmtParams `cbor:"2,keyasint,omitempty"`
+	PINProtocol uint            `cbor:"3,keyasint,omitempty"`
+	PINAuth     []byte          `cbor:"4,keyasint,omitempty"`
+}
+
+type credMgmtResponse struct {
+	RP               *RelyingParty         `cbor:"3,keyasint,omitempty"`
+	RPIDHash         []byte                `cbor:"4,keyasint,omitempty"`
+	TotalRPs         uint                  `cbor:"5,keyasint,omitempty"`
+	User             *User                 `cbor:"6,keyasint,omitempty"`
+	CredentialID     *CredentialDescriptor `cbor:"7,keyasint,omitempty"`
+	PublicKey        *COSEKey              `cbor:"8,keyasint,omitempty"`
+	TotalCredentials uint                  `cbor:"9,keyasint,omitempty"`
+}
+
+// ResidentCredential is a discoverable credential stored on an authenticator
+type ResidentCredential struct {
+	RPID      string
+	User      User
+	ID        []byte
+	PublicKey *COSEKey
+}
+
+func (c *Client) credMgmt(cmd byte, token []byte, sub uint, params *credMgmtParams, res *credMgmtResponse) error {
+	req := credMgmtRequest{SubCommand: sub, Params: params}
+
+	if token != nil {
+		// pinAuth covers the subcommand and its encoded parameters
+		msg := []byte{byte(sub)}
+		if params != nil {
+			body, err := encMode.Marshal(params)
+			if err != nil {
+				return err
+			}
+			msg = append(msg, body...)
+		}
+		req.PINProtocol = 1
+		req.PINAuth = pinAuth(token, msg)
+	}
+	return c.call(cmd, &req, res)
+}
+
+// ResidentCredentials enumerates the discoverable credentials for relying
+// parties accepted by filter. A PIN token is required
+func (c *Client) ResidentCredentials(info *Info, token []byte, filter func(rpID string) bool) ([]ResidentCredential, error) {
+	cmd := info.credentialManagementCommand()
+	if cmd == 0 {
+		return nil, errors.New("ctap2: credential management not supported")
+	}
+
+	var rps []credMgmtResponse
+	var res credMgmtResponse
+	err := c.credMgmt(cmd, token, credMgmtEnumerateRPsBegin, nil, &res)
+	if err == StatusNoCredentials {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rps = append(rps, res)
+
+	for i := uint(1); i < res.TotalRPs; i++ {
+		var next credMgmtResponse
+		if err := c.credMgmt(cmd, nil, credMgmtEnumerateRPsGetNext, nil, &next); err != nil {
+			return nil, err
+		}
+		rps = append(rps, next)
+	}
+
+	var creds []ResidentCredential
+	for _, rp := range rps {
+		if rp.RP == nil || !filter(rp.RP.ID) {
+			continue
+		}
+
+		params := &credMgmtParams{RPIDHash: rp.RPIDHash}
+		var cred credMgmtResponse
+		if err := c.credMgmt(cmd, token, credMgmtEnumerateCredentialsBegin, params, &cred); err != nil {
+			return nil, err
+		}
+
+		total := cred.TotalCredentials
+		for i := uint(0); ; i++ {
+			if cred.CredentialID != nil && cred.PublicKey != nil {
+				rc := ResidentCredential{
+					RPID:      rp.RP.ID,
+					ID:        cred.CredentialID.ID,
+					PublicKey: cred.PublicKey,
+				}
+				if cred.User != nil {
+					rc.User = *cred.User
+				}
+				creds = append(creds, rc)
+			}
+
+			if i+1 >= total {
+				break
+			}
+
+			cred = credMgmtResponse{}
+			if err := c.credMgmt(cmd, nil, credMgmtEnumerateCredentialsNext, nil, &cred); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return creds, nil
+}
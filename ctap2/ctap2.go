@@ -0,0 +1,355 @@
+// Package ctap2 implements a FIDO2 CTAP2 client
+package ctap2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// Transport carries CTAP2 requests to an authenticator
+type Transport interface {
+	CBOR(data []byte) ([]byte, error)
+}
+
+// Authenticator commands
+const (
+	cmdMakeCredential       = 0x01
+	cmdGetAssertion         = 0x02
+	cmdGetInfo              = 0x04
+	cmdClientPIN            = 0x06
+	cmdGetNextAssertion     = 0x08
+	cmdCredentialManagement = 0x0a
+	// Used by authenticators implementing the CTAP 2.1 preview
+	cmdCredentialManagementPreview = 0x41
+)
+
+// Status is a CTAP2 status code
+type Status byte
+
+const (
+	StatusOK                Status = 0x00
+	StatusOperationDenied   Status = 0x27
+	StatusKeepaliveCancel   Status = 0x2d
+	StatusNoCredentials     Status = 0x2e
+	StatusUserActionTimeout Status = 0x2f
+	StatusPINInvalid        Status = 0x31
+	StatusPINBlocked        Status = 0x32
+	StatusPINAuthInvalid    Status = 0x33
+	StatusPINNotSet         Status = 0x35
+	StatusPINRequired       Status = 0x36
+)
+
+func (s Status) Error() string {
+	return fmt.Sprintf("ctap2: status %#02x", byte(s))
+}
+
+// COSE algorithm identifiers
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+)
+
+var encMode cbor.EncMode
+
+func init() {
+	var err error
+	encMode, err = cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Client issues CTAP2 commands to an authenticator
+type Client struct {
+	t Transport
+}
+
+func NewClient(t Transport) *Client {
+	return &Client{t: t}
+}
+
+// call sends a command with an optional CBOR encoded request, decoding
+// the response into res if non-nil
+func (c *Client) call(cmd byte, req interface{}, res interface{}) error {
+	msg := []byte{cmd}
+	if req != nil {
+		body, err := encMode.Marshal(req)
+		if err != nil {
+			return err
+		}
+		msg = append(msg, body...)
+	}
+
+	resp, err := c.t.CBOR(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(resp) == 0 {
+		return errors.New("ctap2: empty response")
+	}
+	if Status(resp[0]) != StatusOK {
+		return Status(resp[0])
+	}
+
+	if res != nil && len(resp) > 1 {
+		if err := cbor.Unmarshal(resp[1:], res); err != nil {
+			return errors.Wrap(err, "ctap2: decoding response")
+		}
+	}
+	return nil
+}
+
+// Info is the response to authenticatorGetInfo
+type Info struct {
+	Versions     []string        `cbor:"1,keyasint"`
+	Extensions   []string        `cbor:"2,keyasint,omitempty"`
+	AAGUID       []byte          `cbor:"3,keyasint"`
+	Options      map[string]bool `cbor:"4,keyasint,omitempty"`
+	MaxMsgSize   uint            `cbor:"5,keyasint,omitempty"`
+	PINProtocols []uint          `cbor:"6,keyasint,omitempty"`
+}
+
+func (c *Client) GetInfo() (*Info, error) {
+	var info Info
+	if err := c.call(cmdGetInfo, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// credentialManagementCommand returns the command used for credential
+// management, or 0 if it is unsupported
+func (info *Info) credentialManagementCommand() byte {
+	if info.Options["credMgmt"] {
+		return cmdCredentialManagement
+	}
+	if info.Options["credentialMgmtPreview"] {
+		return cmdCredentialManagementPreview
+	}
+	return 0
+}
+
+type RelyingParty struct {
+	ID   string `cbor:"id"`
+	Name string `cbor:"name,omitempty"`
+}
+
+type User struct {
+	ID          []byte `cbor:"id"`
+	Name        string `cbor:"name,omitempty"`
+	DisplayName string `cbor:"displayName,omitempty"`
+}
+
+type CredentialDescriptor struct {
+	Type string `cbor:"type"`
+	ID   []byte `cbor:"id"`
+}
+
+type credentialParameter struct {
+	Type string `cbor:"type"`
+	Alg  int    `cbor:"alg"`
+}
+
+type makeCredentialRequest struct {
+	ClientDataHash   []byte                `cbor:"1,keyasint"`
+	RP               RelyingParty          `cbor:"2,keyasint"`
+	User             User                  `cbor:"3,keyasint"`
+	PubKeyCredParams []credentialParameter `cbor:"4,keyasint"`
+	Options          map[string]bool       `cbor:"7,keyasint,omitempty"`
+	PINAuth          []byte                `cbor:"8,keyasint,omitempty"`
+	PINProtocol      uint                  `cbor:"9,keyasint,omitempty"`
+}
+
+type makeCredentialResponse struct {
+	Fmt      string          `cbor:"1,keyasint"`
+	AuthData []byte          `cbor:"2,keyasint"`
+	AttStmt  cbor.RawMessage `cbor:"3,keyasint"`
+}
+
+// MakeCredentialOptions describes a credential to create
+type MakeCredentialOptions struct {
+	RP             RelyingParty
+	User           User
+	ClientDataHash []byte
+	Algorithm      int
+	Resident       bool
+	// PINToken, if set, is used to authorise the request
+	PINToken []byte
+}
+
+// Credential is a newly created credential
+type Credential struct {
+	ID        []byte
+	PublicKey *COSEKey
+	AuthData  *AuthData
+}
+
+func (c *Client) MakeCredential(opts MakeCredentialOptions) (*Credential, error) {
+	req := makeCredentialRequest{
+		ClientDataHash:   opts.ClientDataHash,
+		RP:               opts.RP,
+		User:             opts.User,
+		PubKeyCredParams: []credentialParameter{{"public-key", opts.Algorithm}},
+	}
+	if opts.Resident {
+		req.Options = map[string]bool{"rk": true}
+	}
+	if opts.PINToken != nil {
+		req.PINAuth = pinAuth(opts.PINToken, opts.ClientDataHash)
+		req.PINProtocol = 1
+	}
+
+	var res makeCredentialResponse
+	if err := c.call(cmdMakeCredential, &req, &res); err != nil {
+		return nil, err
+	}
+
+	ad, err := ParseAuthData(res.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, errors.New("ctap2: no attested credential data")
+	}
+
+	return &Credential{
+		ID:        ad.CredentialID,
+		PublicKey: ad.CredentialPublicKey,
+		AuthData:  ad,
+	}, nil
+}
+
+// selectionRequest is a makeCredential request with an empty pinAuth,
+// which authenticators answer once touched without creating a credential
+type selectionRequest struct {
+	ClientDataHash   []byte                `cbor:"1,keyasint"`
+	RP               RelyingParty          `cbor:"2,keyasint"`
+	User             User                  `cbor:"3,keyasint"`
+	PubKeyCredParams []credentialParameter `cbor:"4,keyasint"`
+	PINAuth          []byte                `cbor:"8,keyasint"`
+	PINProtocol      uint                  `cbor:"9,keyasint"`
+}
+
+// Select waits for the user to touch the authenticator, so that one of
+// several can be chosen
+func (c *Client) Select() error {
+	err := c.call(cmdMakeCredential, &selectionRequest{
+		ClientDataHash:   make([]byte, 32),
+		RP:               RelyingParty{ID: ".dummy"},
+		User:             User{ID: []byte{0}, Name: "dummy"},
+		PubKeyCredParams: []credentialParameter{{"public-key", AlgES256}},
+		PINAuth:          []byte{},
+		PINProtocol:      1,
+	}, nil)
+
+	// The authenticator reports that the empty pinAuth is wrong once it
+	// has been touched
+	if err == nil || err == StatusPINNotSet || err == StatusPINInvalid {
+		return nil
+	}
+	return err
+}
+
+type getAssertionRequest struct {
+	RPID           string                 `cbor:"1,keyasint"`
+	ClientDataHash []byte                 `cbor:"2,keyasint"`
+	AllowList      []CredentialDescriptor `cbor:"3,keyasint,omitempty"`
+	Options        map[string]bool        `cbor:"5,keyasint,omitempty"`
+	PINAuth        []byte                 `cbor:"6,keyasint,omitempty"`
+	PINProtocol    uint                   `cbor:"7,keyasint,omitempty"`
+}
+
+// Assertion is the response to authenticatorGetAssertion
+type Assertion struct {
+	Credential          *CredentialDescriptor `cbor:"1,keyasint,omitempty"`
+	AuthData            []byte                `cbor:"2,keyasint"`
+	Signature           []byte                `cbor:"3,keyasint"`
+	User                *User                 `cbor:"4,keyasint,omitempty"`
+	NumberOfCredentials uint                  `cbor:"5,keyasint,omitempty"`
+}
+
+// GetAssertionOptions describes an assertion request
+type GetAssertionOptions struct {
+	RPID           string
+	ClientDataHash []byte
+	CredentialIDs  [][]byte
+	// Silent requests an assertion without user presence, to check
+	// whether the authenticator holds a credential
+	Silent   bool
+	PINToken []byte
+}
+
+func (c *Client) GetAssertion(opts GetAssertionOptions) (*Assertion, error) {
+	req := getAssertionRequest{
+		RPID:           opts.RPID,
+		ClientDataHash: opts.ClientDataHash,
+	}
+	for _, id := range opts.CredentialIDs {
+		req.AllowList = append(req.AllowList, CredentialDescriptor{"public-key", id})
+	}
+	if opts.Silent {
+		req.Options = map[string]bool{"up": false}
+	}
+	if opts.PINToken != nil {
+		req.PINAuth = pinAuth(opts.PINToken, opts.ClientDataHash)
+		req.PINProtocol = 1
+	}
+
+	var res Assertion
+	if err := c.call(cmdGetAssertion, &req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AuthData is parsed authenticator data
+type AuthData struct {
+	RPIDHash []byte
+	Flags    byte
+	Counter  uint32
+
+	// Set if attested credential data is present
+	AAGUID              []byte
+	CredentialID        []byte
+	CredentialPublicKey *COSEKey
+}
+
+const flagAttestedCredentialData = 0x40
+
+func ParseAuthData(data []byte) (*AuthData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("ctap2: short authenticator data")
+	}
+
+	ad := &AuthData{
+		RPIDHash: data[:32],
+		Flags:    data[32],
+		Counter:  binary.BigEndian.Uint32(data[33:]),
+	}
+
+	if ad.Flags&flagAttestedCredentialData != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("ctap2: short attested credential data")
+		}
+		ad.AAGUID = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("ctap2: short credential ID")
+		}
+		ad.CredentialID = rest[:idLen]
+
+		var key COSEKey
+		if err := cbor.NewDecoder(bytes.NewReader(rest[idLen:])).Decode(&key); err != nil {
+			return nil, errors.Wrap(err, "ctap2: decoding credential public key")
+		}
+		ad.CredentialPublicKey = &key
+	}
+	return ad, nil
+}
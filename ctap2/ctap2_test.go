@@ -0,0 +1,358 @@
+package ctap2_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/erincandescent/ssh-emissary/ctap2/ctap2test"
+	"github.com/flynn/hid"
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newClient(t *testing.T, pin string) (*ctap2.Client, *ctap2.HIDDevice, *ctap2test.Authenticator) {
+	auth := ctap2test.New(pin)
+	dev, err := ctap2.NewHIDDevice(&hid.DeviceInfo{Product: "test"}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctap2.NewClient(dev), dev, auth
+}
+
+// lastRequest decodes the last CBOR request the authenticator received,
+// checking its command
+func lastRequest(t *testing.T, auth *ctap2test.Authenticator, cmd byte) map[int]cbor.RawMessage {
+	t.Helper()
+
+	reqs := auth.Requests()
+	req := reqs[len(reqs)-1]
+	if req[0] != cmd {
+		t.Fatalf("Sent command %#x, want %#x", req[0], cmd)
+	}
+
+	var m map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(req[1:], &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func keys(m map[int]cbor.RawMessage) []int {
+	var k []int
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Ints(k)
+	return k
+}
+
+func checkKeys(t *testing.T, m map[int]cbor.RawMessage, want ...int) {
+	t.Helper()
+	got := keys(m)
+	if len(got) != len(want) {
+		t.Fatalf("Request has keys %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Request has keys %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	client, _, auth := newClient(t, "")
+
+	info, err := client.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Versions) == 0 || info.Versions[0] != "FIDO_2_0" || !info.Options["rk"] {
+		t.Errorf("Got info %+v", info)
+	}
+
+	reqs := auth.Requests()
+	if len(reqs[0]) != 1 {
+		t.Errorf("getInfo request %x has parameters", reqs[0])
+	}
+}
+
+func TestMakeCredentialAndAssertion(t *testing.T) {
+	client, _, auth := newClient(t, "")
+
+	cdh := sha256.Sum256([]byte("challenge"))
+	cred, err := client.MakeCredential(ctap2.MakeCredentialOptions{
+		RP:             ctap2.RelyingParty{ID: "ssh:"},
+		User:           ctap2.User{ID: []byte{1, 2, 3}, Name: "alice"},
+		ClientDataHash: cdh[:],
+		Algorithm:      ctap2.AlgES256,
+		Resident:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := lastRequest(t, auth, 0x01)
+	checkKeys(t, req, 1, 2, 3, 4, 7)
+	var options map[string]bool
+	cbor.Unmarshal(req[7], &options)
+	if !options["rk"] {
+		t.Errorf("Resident credential not requested: %v", options)
+	}
+
+	stored := auth.Credentials()
+	if len(stored) != 1 || string(stored[0].ID) != string(cred.ID) {
+		t.Fatalf("Credential ID %x not stored", cred.ID)
+	}
+	pub, err := cred.PublicKey.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPub := pub.(*ecdsa.PublicKey)
+	if ecPub.X.Cmp(stored[0].Key.Public().(*ecdsa.PublicKey).X) != 0 {
+		t.Error("Credential public key doesn't match")
+	}
+	rpHash := sha256.Sum256([]byte("ssh:"))
+	if string(cred.AuthData.RPIDHash) != string(rpHash[:]) {
+		t.Error("Wrong RP ID hash")
+	}
+
+	// A silent assertion finds the credential without user presence
+	a, err := client.GetAssertion(ctap2.GetAssertionOptions{
+		RPID:           "ssh:",
+		ClientDataHash: cdh[:],
+		CredentialIDs:  [][]byte{cred.ID},
+		Silent:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = lastRequest(t, auth, 0x02)
+	checkKeys(t, req, 1, 2, 3, 5)
+	if a.AuthData[32]&0x01 != 0 {
+		t.Error("Silent assertion has user presence flag")
+	}
+
+	a, err = client.GetAssertion(ctap2.GetAssertionOptions{
+		RPID:           "ssh:",
+		ClientDataHash: cdh[:],
+		CredentialIDs:  [][]byte{cred.ID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKeys(t, lastRequest(t, auth, 0x02), 1, 2, 3)
+
+	signed := sha256.Sum256(append(append([]byte(nil), a.AuthData...), cdh[:]...))
+	if !ecdsa.VerifyASN1(ecPub, signed[:], a.Signature) {
+		t.Error("Assertion signature doesn't verify")
+	}
+
+	// Unknown credentials are reported
+	_, err = client.GetAssertion(ctap2.GetAssertionOptions{
+		RPID:           "ssh:",
+		ClientDataHash: cdh[:],
+		CredentialIDs:  [][]byte{{9, 9, 9}},
+	})
+	if err != ctap2.StatusNoCredentials {
+		t.Errorf("Got %v for unknown credential", err)
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	client, _, _ := newClient(t, "")
+
+	cdh := make([]byte, 32)
+	cred, err := client.MakeCredential(ctap2.MakeCredentialOptions{
+		RP:             ctap2.RelyingParty{ID: "ssh:"},
+		User:           ctap2.User{ID: []byte{1}},
+		ClientDataHash: cdh,
+		Algorithm:      ctap2.AlgEdDSA,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := cred.PublicKey.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := client.GetAssertion(ctap2.GetAssertionOptions{
+		RPID:           "ssh:",
+		ClientDataHash: cdh,
+		CredentialIDs:  [][]byte{cred.ID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub.(ed25519.PublicKey), append(a.AuthData, cdh...), a.Signature) {
+		t.Error("Ed25519 assertion doesn't verify")
+	}
+}
+
+func TestClientPIN(t *testing.T) {
+	client, _, auth := newClient(t, "1234")
+
+	opts := ctap2.MakeCredentialOptions{
+		RP:             ctap2.RelyingParty{ID: "ssh:"},
+		User:           ctap2.User{ID: []byte{1}},
+		ClientDataHash: make([]byte, 32),
+		Algorithm:      ctap2.AlgES256,
+	}
+	if _, err := client.MakeCredential(opts); err != ctap2.StatusPINRequired {
+		t.Fatalf("Got %v without a PIN token", err)
+	}
+
+	if _, err := client.GetPINToken("4321"); err != ctap2.StatusPINInvalid {
+		t.Fatalf("Got %v for the wrong PIN", err)
+	}
+	req := lastRequest(t, auth, 0x06)
+	checkKeys(t, req, 1, 2, 3, 6)
+
+	retries, err := client.PINRetries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries != 7 {
+		t.Errorf("Got %d retries, want 7", retries)
+	}
+	checkKeys(t, lastRequest(t, auth, 0x06), 1, 2)
+
+	token, err := client.GetPINToken("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.PINToken = token
+	if _, err := client.MakeCredential(opts); err != nil {
+		t.Fatal(err)
+	}
+	req = lastRequest(t, auth, 0x01)
+	checkKeys(t, req, 1, 2, 3, 4, 8, 9)
+	var proto uint
+	cbor.Unmarshal(req[9], &proto)
+	if proto != 1 {
+		t.Errorf("Got PIN protocol %d", proto)
+	}
+
+	opts.PINToken = []byte("not the token, but the right size")[:32]
+	if _, err := client.MakeCredential(opts); err != ctap2.StatusPINAuthInvalid {
+		t.Errorf("Got %v with the wrong PIN token", err)
+	}
+}
+
+func TestResidentCredentials(t *testing.T) {
+	client, _, auth := newClient(t, "1234")
+
+	token, err := client.GetPINToken("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct{ rp, user string }{
+		{"ssh:", "alice"},
+		{"webauthn.io", "bob"},
+		{"ssh:", "carol"},
+		{"ssh:work", "dave"},
+	} {
+		_, err := client.MakeCredential(ctap2.MakeCredentialOptions{
+			RP:             ctap2.RelyingParty{ID: c.rp},
+			User:           ctap2.User{ID: []byte(c.user), Name: c.user},
+			ClientDataHash: make([]byte, 32),
+			Algorithm:      ctap2.AlgES256,
+			Resident:       true,
+			PINToken:       token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := client.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(auth.Requests())
+	creds, err := client.ResidentCredentials(info, token, func(rpID string) bool {
+		return strings.HasPrefix(rpID, "ssh:")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var users []string
+	for _, c := range creds {
+		if !strings.HasPrefix(c.RPID, "ssh:") || c.PublicKey == nil || len(c.ID) == 0 {
+			t.Errorf("Got credential %+v", c)
+		}
+		users = append(users, c.User.Name)
+	}
+	sort.Strings(users)
+	if strings.Join(users, ",") != "alice,carol,dave" {
+		t.Errorf("Got credentials of %v", users)
+	}
+
+	// Only the first request of each enumeration is authenticated
+	var subcommands []uint
+	for _, req := range auth.Requests()[before:] {
+		var m struct {
+			SubCommand uint   `cbor:"1,keyasint"`
+			PINAuth    []byte `cbor:"4,keyasint"`
+		}
+		if req[0] != 0x0a {
+			t.Fatalf("Sent command %#x", req[0])
+		}
+		if err := cbor.Unmarshal(req[1:], &m); err != nil {
+			t.Fatal(err)
+		}
+		begin := m.SubCommand == 2 || m.SubCommand == 4
+		if begin != (m.PINAuth != nil) {
+			t.Errorf("Subcommand %d has pinAuth %x", m.SubCommand, m.PINAuth)
+		}
+		subcommands = append(subcommands, m.SubCommand)
+	}
+	want := []uint{2, 3, 3, 4, 5, 4}
+	if len(subcommands) != len(want) {
+		t.Fatalf("Sent subcommands %v, want %v", subcommands, want)
+	}
+	for i := range want {
+		if subcommands[i] != want[i] {
+			t.Fatalf("Sent subcommands %v, want %v", subcommands, want)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	client, dev, auth := newClient(t, "1234")
+	auth.Touch = make(chan struct{})
+
+	var presence bool
+	dev.OnPresenceNeeded = func() { presence = true }
+
+	done := make(chan error)
+	go func() { done <- client.Select() }()
+	auth.Touch <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !presence {
+		t.Error("OnPresenceNeeded not called")
+	}
+	if len(auth.Credentials()) != 0 {
+		t.Error("Selection created a credential")
+	}
+
+	// An abandoned selection is cancelled
+	go func() { done <- client.Select() }()
+	time.Sleep(50 * time.Millisecond)
+	dev.Cancel()
+	if err := <-done; err != ctap2.StatusKeepaliveCancel {
+		t.Errorf("Got %v after cancelling", err)
+	}
+}
@@ -0,0 +1,664 @@
+// Package ctap2test implements a software CTAP2 authenticator, attached
+// through a fake USB HID device, for testing
+package ctap2test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/flynn/hid"
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/ed25519"
+)
+
+// CTAPHID commands
+const (
+	cmdMsg       = 0x83
+	cmdInit      = 0x86
+	cmdCBOR      = 0x90
+	cmdCancel    = 0x91
+	cmdKeepalive = 0xbb
+
+	reportLen = 64
+
+	// channel is the channel allocated to every client
+	channel = 0x01020304
+)
+
+// Authenticator commands
+const (
+	cmdMakeCredential       = 0x01
+	cmdGetAssertion         = 0x02
+	cmdGetInfo              = 0x04
+	cmdClientPIN            = 0x06
+	cmdCredentialManagement = 0x0a
+)
+
+// Credential is a credential created on the authenticator
+type Credential struct {
+	RPID     string
+	User     ctap2.User
+	ID       []byte
+	Key      crypto.Signer
+	Resident bool
+}
+
+// Authenticator is a software CTAP2 authenticator. It implements
+// hid.Device, so it can be used with ctap2.NewHIDDevice
+type Authenticator struct {
+	// PIN is the authenticator's PIN, or empty if none is set
+	PIN string
+	// Touch, if set, receives once for each operation needing the user's
+	// presence. Otherwise the user is always present
+	Touch chan struct{}
+
+	mu          sync.Mutex
+	credentials []*Credential
+	// Requests records every CBOR request received, starting with the
+	// command byte
+	requests [][]byte
+	counter  uint32
+	retries  uint
+	token    []byte
+	agree    *ecdsa.PrivateKey
+	// Iteration state of credential management
+	rps   []string
+	creds []*Credential
+
+	readCh chan []byte
+	cancel chan struct{}
+	// The message being received
+	msg     []byte
+	msgCmd  byte
+	msgLen  int
+	working sync.Mutex
+}
+
+var _ hid.Device = &Authenticator{}
+
+// New creates an authenticator with the given PIN, which may be empty
+func New(pin string) *Authenticator {
+	agree, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	return &Authenticator{
+		PIN:     pin,
+		retries: 8,
+		agree:   agree,
+		readCh:  make(chan []byte, 1024),
+		cancel:  make(chan struct{}, 1),
+	}
+}
+
+// Credentials returns the credentials created so far
+func (a *Authenticator) Credentials() []*Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Credential(nil), a.credentials...)
+}
+
+// Requests returns the CBOR requests received so far
+func (a *Authenticator) Requests() [][]byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([][]byte(nil), a.requests...)
+}
+
+// Close implements hid.Device
+func (a *Authenticator) Close() {}
+
+// ReadCh implements hid.Device
+func (a *Authenticator) ReadCh() <-chan []byte {
+	return a.readCh
+}
+
+// ReadError implements hid.Device
+func (a *Authenticator) ReadError() error {
+	return nil
+}
+
+// Write receives a HID report
+func (a *Authenticator) Write(report []byte) error {
+	if len(report) != reportLen {
+		panic("ctap2test: report is not 64 bytes")
+	}
+
+	if report[4]&0x80 != 0 {
+		cmd := report[4]
+		if cmd == cmdCancel {
+			select {
+			case a.cancel <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+
+		a.msgCmd = cmd
+		a.msgLen = int(binary.BigEndian.Uint16(report[5:]))
+		a.msg = append([]byte(nil), report[7:]...)
+	} else {
+		a.msg = append(a.msg, report[5:]...)
+	}
+
+	if len(a.msg) < a.msgLen {
+		return nil
+	}
+
+	cmd, msg := a.msgCmd, a.msg[:a.msgLen]
+	a.msg = nil
+
+	// Forget cancellations of earlier requests. A cancellation of this one
+	// may arrive before it is handled
+	select {
+	case <-a.cancel:
+	default:
+	}
+	go a.handle(binary.BigEndian.Uint32(report), cmd, msg)
+	return nil
+}
+
+// handle processes a complete message
+func (a *Authenticator) handle(ch uint32, cmd byte, msg []byte) {
+	a.working.Lock()
+	defer a.working.Unlock()
+
+	switch cmd {
+	case cmdInit:
+		// nonce | channel | protocol version | major | minor | build | capabilities
+		res := append([]byte(nil), msg...)
+		res = append(res, 0, 0, 0, 0, 2, 1, 0, 0, 0x05)
+		binary.BigEndian.PutUint32(res[8:], channel)
+		a.send(ch, cmdInit, res)
+	case cmdMsg:
+		// U2F isn't supported
+		a.send(ch, cmdMsg, []byte{0x6d, 0x00})
+	case cmdCBOR:
+		a.send(ch, cmdCBOR, a.cbor(ch, msg))
+	}
+}
+
+// send frames a response into reports
+func (a *Authenticator) send(ch uint32, cmd byte, data []byte) {
+	report := make([]byte, reportLen)
+	binary.BigEndian.PutUint32(report, ch)
+	report[4] = cmd
+	binary.BigEndian.PutUint16(report[5:], uint16(len(data)))
+	n := copy(report[7:], data)
+	data = data[n:]
+	a.readCh <- report
+
+	for seq := byte(0); len(data) > 0; seq++ {
+		report := make([]byte, reportLen)
+		binary.BigEndian.PutUint32(report, ch)
+		report[4] = seq
+		n := copy(report[5:], data)
+		data = data[n:]
+		a.readCh <- report
+	}
+}
+
+// waitTouch waits for the user, sending keepalives, and returns false if
+// the request is cancelled
+func (a *Authenticator) waitTouch(ch uint32) bool {
+	if a.Touch == nil {
+		return true
+	}
+
+	a.send(ch, cmdKeepalive, []byte{2})
+	select {
+	case <-a.Touch:
+		return true
+	case <-a.cancel:
+		return false
+	}
+}
+
+func status(s ctap2.Status) []byte {
+	return []byte{byte(s)}
+}
+
+func reply(v interface{}) []byte {
+	enc, err := cbor.CTAP2EncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	body, err := enc.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{byte(ctap2.StatusOK)}, body...)
+}
+
+func (a *Authenticator) cbor(ch uint32, msg []byte) []byte {
+	a.mu.Lock()
+	a.requests = append(a.requests, append([]byte(nil), msg...))
+	a.mu.Unlock()
+
+	if len(msg) == 0 {
+		return status(0x01)
+	}
+
+	switch msg[0] {
+	case cmdGetInfo:
+		return reply(map[int]interface{}{
+			1: []string{"FIDO_2_0"},
+			3: make([]byte, 16),
+			4: map[string]bool{"rk": true, "up": true, "clientPin": a.PIN != "", "credMgmt": true},
+			6: []uint{1},
+		})
+	case cmdMakeCredential:
+		return a.makeCredential(ch, msg[1:])
+	case cmdGetAssertion:
+		return a.getAssertion(ch, msg[1:])
+	case cmdClientPIN:
+		return a.clientPIN(msg[1:])
+	case cmdCredentialManagement:
+		return a.credentialManagement(msg[1:])
+	}
+	return status(0x01)
+}
+
+// checkPINAuth checks the pinAuth of a request. PIN protected requests
+// without one are refused
+func (a *Authenticator) checkPINAuth(pinAuth []byte, data []byte) ctap2.Status {
+	if a.PIN == "" {
+		return ctap2.StatusOK
+	}
+	if pinAuth == nil {
+		return ctap2.StatusPINRequired
+	}
+
+	a.mu.Lock()
+	token := a.token
+	a.mu.Unlock()
+
+	mac := hmac.New(sha256.New, token)
+	mac.Write(data)
+	if token == nil || !hmac.Equal(mac.Sum(nil)[:16], pinAuth) {
+		return ctap2.StatusPINAuthInvalid
+	}
+	return ctap2.StatusOK
+}
+
+type makeCredentialRequest struct {
+	ClientDataHash []byte             `cbor:"1,keyasint"`
+	RP             ctap2.RelyingParty `cbor:"2,keyasint"`
+	User           ctap2.User         `cbor:"3,keyasint"`
+	Params         []struct {
+		Type string `cbor:"type"`
+		Alg  int    `cbor:"alg"`
+	} `cbor:"4,keyasint"`
+	Options     map[string]bool `cbor:"7,keyasint"`
+	PINAuth     []byte          `cbor:"8,keyasint"`
+	PINProtocol uint            `cbor:"9,keyasint"`
+}
+
+func (a *Authenticator) makeCredential(ch uint32, body []byte) []byte {
+	var req makeCredentialRequest
+	if err := cbor.Unmarshal(body, &req); err != nil {
+		return status(0x12)
+	}
+
+	if req.PINAuth != nil && len(req.PINAuth) == 0 {
+		// Touch to select
+		if !a.waitTouch(ch) {
+			return status(ctap2.StatusKeepaliveCancel)
+		}
+		if a.PIN == "" {
+			return status(ctap2.StatusPINNotSet)
+		}
+		return status(ctap2.StatusPINInvalid)
+	}
+
+	if s := a.checkPINAuth(req.PINAuth, req.ClientDataHash); s != ctap2.StatusOK {
+		return status(s)
+	}
+	if len(req.Params) == 0 {
+		return status(0x26)
+	}
+
+	var key crypto.Signer
+	var cose ctap2.COSEKey
+	switch req.Params[0].Alg {
+	case ctap2.AlgES256:
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		key = k
+		cose = ctap2.COSEKey{KeyType: 2, Algorithm: ctap2.AlgES256, Curve: 1,
+			X: k.X.FillBytes(make([]byte, 32)), Y: k.Y.FillBytes(make([]byte, 32))}
+	case ctap2.AlgEdDSA:
+		pub, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		key = k
+		cose = ctap2.COSEKey{KeyType: 1, Algorithm: ctap2.AlgEdDSA, Curve: 6, X: pub}
+	default:
+		return status(0x26)
+	}
+
+	if !a.waitTouch(ch) {
+		return status(ctap2.StatusKeepaliveCancel)
+	}
+
+	cred := &Credential{
+		RPID:     req.RP.ID,
+		User:     req.User,
+		ID:       make([]byte, 16),
+		Key:      key,
+		Resident: req.Options["rk"],
+	}
+	rand.Read(cred.ID)
+
+	coseBytes, err := cbor.Marshal(&cose)
+	if err != nil {
+		panic(err)
+	}
+
+	a.mu.Lock()
+	a.credentials = append(a.credentials, cred)
+	a.counter++
+	authData := a.authData(cred.RPID, 0x41, a.counter)
+	a.mu.Unlock()
+
+	// AAGUID | credential ID length | credential ID | public key
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, 0, byte(len(cred.ID)))
+	authData = append(authData, cred.ID...)
+	authData = append(authData, coseBytes...)
+
+	return reply(map[int]interface{}{
+		1: "none",
+		2: authData,
+		3: map[string]interface{}{},
+	})
+}
+
+func (a *Authenticator) authData(rpID string, flags byte, counter uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], counter)
+	return data
+}
+
+type getAssertionRequest struct {
+	RPID           string                       `cbor:"1,keyasint"`
+	ClientDataHash []byte                       `cbor:"2,keyasint"`
+	AllowList      []ctap2.CredentialDescriptor `cbor:"3,keyasint"`
+	Options        map[string]bool              `cbor:"5,keyasint"`
+	PINAuth        []byte                       `cbor:"6,keyasint"`
+	PINProtocol    uint                         `cbor:"7,keyasint"`
+}
+
+func (a *Authenticator) getAssertion(ch uint32, body []byte) []byte {
+	var req getAssertionRequest
+	if err := cbor.Unmarshal(body, &req); err != nil {
+		return status(0x12)
+	}
+
+	var cred *Credential
+	for _, c := range a.Credentials() {
+		if c.RPID != req.RPID {
+			continue
+		}
+		for _, d := range req.AllowList {
+			if bytes.Equal(d.ID, c.ID) {
+				cred = c
+			}
+		}
+	}
+	if cred == nil {
+		return status(ctap2.StatusNoCredentials)
+	}
+
+	if req.PINAuth != nil {
+		if s := a.checkPINAuth(req.PINAuth, req.ClientDataHash); s != ctap2.StatusOK {
+			return status(s)
+		}
+	}
+
+	flags := byte(0x01)
+	if up, ok := req.Options["up"]; ok && !up {
+		flags = 0
+	} else if !a.waitTouch(ch) {
+		return status(ctap2.StatusKeepaliveCancel)
+	}
+
+	a.mu.Lock()
+	a.counter++
+	authData := a.authData(cred.RPID, flags, a.counter)
+	a.mu.Unlock()
+
+	signed := append(append([]byte(nil), authData...), req.ClientDataHash...)
+	var sig []byte
+	var err error
+	if _, ok := cred.Key.(ed25519.PrivateKey); ok {
+		sig, err = cred.Key.Sign(rand.Reader, signed, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(signed)
+		sig, err = cred.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return reply(map[int]interface{}{
+		1: ctap2.CredentialDescriptor{Type: "public-key", ID: cred.ID},
+		2: authData,
+		3: sig,
+	})
+}
+
+type clientPINRequest struct {
+	PINProtocol  uint           `cbor:"1,keyasint"`
+	SubCommand   uint           `cbor:"2,keyasint"`
+	KeyAgreement *ctap2.COSEKey `cbor:"3,keyasint"`
+	PINHashEnc   []byte         `cbor:"6,keyasint"`
+}
+
+func (a *Authenticator) clientPIN(body []byte) []byte {
+	var req clientPINRequest
+	if err := cbor.Unmarshal(body, &req); err != nil || req.PINProtocol != 1 {
+		return status(0x12)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch req.SubCommand {
+	case 0x01:
+		return reply(map[int]interface{}{3: a.retries})
+
+	case 0x02:
+		return reply(map[int]interface{}{1: &ctap2.COSEKey{
+			KeyType: 2, Algorithm: -25, Curve: 1,
+			X: a.agree.X.FillBytes(make([]byte, 32)),
+			Y: a.agree.Y.FillBytes(make([]byte, 32)),
+		}})
+
+	case 0x05:
+		if a.PIN == "" {
+			return status(ctap2.StatusPINNotSet)
+		}
+		if a.retries == 0 {
+			return status(ctap2.StatusPINBlocked)
+		}
+		if req.KeyAgreement == nil || len(req.PINHashEnc) != 16 {
+			return status(0x14)
+		}
+		return a.pinToken(req)
+	}
+	return status(0x12)
+}
+
+// pinToken checks the encrypted PIN hash and returns the encrypted PIN
+// token
+func (a *Authenticator) pinToken(req clientPINRequest) []byte {
+	pub, err := req.KeyAgreement.PublicKey()
+	if err != nil {
+		return status(0x14)
+	}
+	platformKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return status(0x14)
+	}
+
+	x, _ := elliptic.P256().ScalarMult(platformKey.X, platformKey.Y, a.agree.D.Bytes())
+	secret := sha256.Sum256(x.FillBytes(make([]byte, 32)))
+	block, err := aes.NewCipher(secret[:])
+	if err != nil {
+		panic(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+
+	pinHash := make([]byte, 16)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(pinHash, req.PINHashEnc)
+
+	want := sha256.Sum256([]byte(a.PIN))
+	if !bytes.Equal(pinHash, want[:16]) {
+		a.retries--
+		// A new key agreement key is generated after each failure
+		if a.agree, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+		return status(ctap2.StatusPINInvalid)
+	}
+
+	a.retries = 8
+	a.token = make([]byte, 32)
+	rand.Read(a.token)
+
+	enc := make([]byte, len(a.token))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(enc, a.token)
+	return reply(map[int]interface{}{2: enc})
+}
+
+type credMgmtRequest struct {
+	SubCommand  uint            `cbor:"1,keyasint"`
+	Params      cbor.RawMessage `cbor:"2,keyasint"`
+	PINProtocol uint            `cbor:"3,keyasint"`
+	PINAuth     []byte          `cbor:"4,keyasint"`
+}
+
+func (a *Authenticator) credentialManagement(body []byte) []byte {
+	var req credMgmtRequest
+	if err := cbor.Unmarshal(body, &req); err != nil {
+		return status(0x12)
+	}
+
+	switch req.SubCommand {
+	case 0x02:
+		if s := a.checkPINAuth(req.PINAuth, []byte{byte(req.SubCommand)}); s != ctap2.StatusOK {
+			return status(s)
+		}
+
+		a.mu.Lock()
+		a.rps = nil
+		seen := make(map[string]bool)
+		for _, c := range a.credentials {
+			if c.Resident && !seen[c.RPID] {
+				seen[c.RPID] = true
+				a.rps = append(a.rps, c.RPID)
+			}
+		}
+		total := len(a.rps)
+		a.mu.Unlock()
+
+		if total == 0 {
+			return status(ctap2.StatusNoCredentials)
+		}
+		res := a.nextRP()
+		res[5] = total
+		return reply(res)
+
+	case 0x03:
+		return reply(a.nextRP())
+
+	case 0x04:
+		msg := append([]byte{byte(req.SubCommand)}, req.Params...)
+		if s := a.checkPINAuth(req.PINAuth, msg); s != ctap2.StatusOK {
+			return status(s)
+		}
+
+		var params struct {
+			RPIDHash []byte `cbor:"1,keyasint"`
+		}
+		if err := cbor.Unmarshal(req.Params, &params); err != nil {
+			return status(0x12)
+		}
+
+		a.mu.Lock()
+		a.creds = nil
+		for _, c := range a.credentials {
+			hash := sha256.Sum256([]byte(c.RPID))
+			if c.Resident && bytes.Equal(hash[:], params.RPIDHash) {
+				a.creds = append(a.creds, c)
+			}
+		}
+		total := len(a.creds)
+		a.mu.Unlock()
+
+		if total == 0 {
+			return status(ctap2.StatusNoCredentials)
+		}
+		res := a.nextCredential()
+		res[9] = total
+		return reply(res)
+
+	case 0x05:
+		return reply(a.nextCredential())
+	}
+	return status(0x12)
+}
+
+func (a *Authenticator) nextRP() map[int]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rp := a.rps[0]
+	a.rps = a.rps[1:]
+	hash := sha256.Sum256([]byte(rp))
+	return map[int]interface{}{
+		3: ctap2.RelyingParty{ID: rp},
+		4: hash[:],
+	}
+}
+
+func (a *Authenticator) nextCredential() map[int]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := a.creds[0]
+	a.creds = a.creds[1:]
+
+	var cose ctap2.COSEKey
+	switch k := c.Key.(type) {
+	case *ecdsa.PrivateKey:
+		cose = ctap2.COSEKey{KeyType: 2, Algorithm: ctap2.AlgES256, Curve: 1,
+			X: k.X.FillBytes(make([]byte, 32)), Y: k.Y.FillBytes(make([]byte, 32))}
+	case ed25519.PrivateKey:
+		cose = ctap2.COSEKey{KeyType: 1, Algorithm: ctap2.AlgEdDSA, Curve: 6,
+			X: k.Public().(ed25519.PublicKey)}
+	}
+
+	return map[int]interface{}{
+		6: c.User,
+		7: ctap2.CredentialDescriptor{Type: "public-key", ID: c.ID},
+		8: &cose,
+	}
+}
@@ -0,0 +1,220 @@
+package ctap2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/flynn/hid"
+	"github.com/pkg/errors"
+)
+
+// CTAPHID constants
+const (
+	reportLen = 64
+
+	broadcastChannel = 0xffffffff
+
+	typeInit = 0x80
+
+	cmdMsg       = typeInit | 0x03
+	cmdInit      = typeInit | 0x06
+	cmdCBOR      = typeInit | 0x10
+	cmdCancel    = typeInit | 0x11
+	cmdKeepalive = typeInit | 0x3b
+	cmdError     = typeInit | 0x3f
+
+	capabilityCBOR = 0x04
+
+	keepaliveUserPresenceNeeded = 2
+
+	// responseTimeout bounds the wait for any single packet. Devices send
+	// keepalives while waiting for the user, so this needn't cover that
+	responseTimeout = 3 * time.Second
+)
+
+// HIDDevice is a CTAP device connected over USB HID
+type HIDDevice struct {
+	Info *hid.DeviceInfo
+
+	dev          hid.Device
+	channel      uint32
+	capabilities byte
+
+	// OnPresenceNeeded is called when the device reports that it is
+	// waiting for the user to touch it
+	OnPresenceNeeded func()
+}
+
+// OpenHID opens a device and allocates a channel on it
+func OpenHID(info *hid.DeviceInfo) (*HIDDevice, error) {
+	dev, err := info.Open()
+	if err != nil {
+		return nil, err
+	}
+	return NewHIDDevice(info, dev)
+}
+
+// NewHIDDevice allocates a channel on an open device, which is closed if
+// this fails
+func NewHIDDevice(info *hid.DeviceInfo, dev hid.Device) (*HIDDevice, error) {
+	d := &HIDDevice{Info: info, dev: dev, channel: broadcastChannel}
+	if err := d.init(); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *HIDDevice) init() error {
+	nonce := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	res, err := d.command(cmdInit, nonce)
+	if err != nil {
+		return errors.Wrap(err, "Initialising channel")
+	}
+
+	// nonce (8) | channel (4) | protocol version | major | minor | build | capabilities
+	if len(res) < 17 || !bytes.Equal(res[:8], nonce) {
+		return errors.New("ctap2: invalid INIT response")
+	}
+	d.channel = binary.BigEndian.Uint32(res[8:])
+	d.capabilities = res[16]
+	return nil
+}
+
+// SupportsCBOR returns true if the device speaks CTAP2
+func (d *HIDDevice) SupportsCBOR() bool {
+	return d.capabilities&capabilityCBOR != 0
+}
+
+func (d *HIDDevice) Close() {
+	d.dev.Close()
+}
+
+// Reset reinitialises the channel, e.g. after an error
+func (d *HIDDevice) Reset() error {
+	d.channel = broadcastChannel
+	return d.init()
+}
+
+// Message sends a U2F APDU
+func (d *HIDDevice) Message(data []byte) ([]byte, error) {
+	return d.command(cmdMsg, data)
+}
+
+// CBOR sends a CTAP2 request
+func (d *HIDDevice) CBOR(data []byte) ([]byte, error) {
+	return d.command(cmdCBOR, data)
+}
+
+// Cancel cancels an outstanding request
+func (d *HIDDevice) Cancel() error {
+	return d.send(cmdCancel, nil)
+}
+
+func (d *HIDDevice) command(cmd byte, data []byte) ([]byte, error) {
+	if err := d.send(cmd, data); err != nil {
+		return nil, err
+	}
+	return d.receive(cmd)
+}
+
+func (d *HIDDevice) send(cmd byte, data []byte) error {
+	var buf [reportLen]byte
+	binary.BigEndian.PutUint32(buf[:], d.channel)
+	buf[4] = cmd
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(data)))
+	n := copy(buf[7:], data)
+	data = data[n:]
+
+	if err := d.dev.Write(buf[:]); err != nil {
+		return err
+	}
+
+	var seq byte
+	for len(data) > 0 {
+		buf = [reportLen]byte{}
+		binary.BigEndian.PutUint32(buf[:], d.channel)
+		buf[4] = seq
+		n := copy(buf[5:], data)
+		data = data[n:]
+		seq++
+
+		if err := d.dev.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *HIDDevice) readPacket() ([]byte, error) {
+	timeout := time.NewTimer(responseTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case msg, ok := <-d.dev.ReadCh():
+			if !ok {
+				return nil, d.dev.ReadError()
+			}
+			// Initialisation packets have 7 header bytes and continuation
+			// packets 5, and every packet we look at has a payload
+			if len(msg) < 8 || binary.BigEndian.Uint32(msg) != d.channel {
+				// Not for us
+				continue
+			}
+			return msg, nil
+		case <-timeout.C:
+			return nil, errors.New("ctap2: timed out reading response")
+		}
+	}
+}
+
+func (d *HIDDevice) receive(cmd byte) ([]byte, error) {
+	var msg []byte
+	for {
+		var err error
+		msg, err = d.readPacket()
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg[4] {
+		case cmdKeepalive:
+			if msg[7] == keepaliveUserPresenceNeeded && d.OnPresenceNeeded != nil {
+				d.OnPresenceNeeded()
+			}
+			continue
+		case cmdError:
+			return nil, errors.Errorf("ctap2: device error %#x", msg[7])
+		case cmd:
+		default:
+			return nil, errors.Errorf("ctap2: unexpected command %#x in response", msg[4])
+		}
+		break
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[5:]))
+	res := make([]byte, 0, length)
+	res = append(res, msg[7:]...)
+
+	var seq byte
+	for len(res) < length {
+		msg, err := d.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if msg[4] != seq {
+			return nil, errors.New("ctap2: out of sequence continuation packet")
+		}
+		res = append(res, msg[5:]...)
+		seq++
+	}
+	return res[:length], nil
+}
@@ -0,0 +1,164 @@
+package ctap2_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/erincandescent/ssh-emissary/ctap2/ctap2test"
+	"github.com/flynn/hid"
+)
+
+// scriptedDevice records the reports written to it and answers with
+// canned reports
+type scriptedDevice struct {
+	written [][]byte
+	readCh  chan []byte
+	// reply is called with each report written
+	reply func(report []byte)
+}
+
+func (d *scriptedDevice) Close() {}
+
+func (d *scriptedDevice) Write(report []byte) error {
+	d.written = append(d.written, append([]byte(nil), report...))
+	if d.reply != nil {
+		d.reply(report)
+	}
+	return nil
+}
+
+func (d *scriptedDevice) ReadCh() <-chan []byte { return d.readCh }
+func (d *scriptedDevice) ReadError() error      { return nil }
+
+func report(header ...byte) []byte {
+	r := make([]byte, 64)
+	copy(r, header)
+	return r
+}
+
+// initialised returns a device which answers the INIT handshake,
+// allocating channel 0x11223344
+func initialised(t *testing.T) (*ctap2.HIDDevice, *scriptedDevice) {
+	d := &scriptedDevice{readCh: make(chan []byte, 16)}
+	d.reply = func(r []byte) {
+		if r[4] != 0x86 {
+			return
+		}
+		res := report(0xff, 0xff, 0xff, 0xff, 0x86, 0, 17)
+		copy(res[7:], r[7:15])
+		copy(res[15:], []byte{0x11, 0x22, 0x33, 0x44, 2, 1, 0, 0, 0x05})
+		d.readCh <- res
+	}
+
+	dev, err := ctap2.NewHIDDevice(&hid.DeviceInfo{Product: "test"}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.written = nil
+	d.reply = nil
+	return dev, d
+}
+
+func TestHIDInit(t *testing.T) {
+	dev, d := initialised(t)
+	if !dev.SupportsCBOR() {
+		t.Error("CBOR capability not recognised")
+	}
+
+	// Requests now use the allocated channel
+	d.readCh <- report(0x11, 0x22, 0x33, 0x44, 0x90, 0, 1, 0)
+	if _, err := dev.CBOR([]byte{0x04}); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint32(d.written[0]); got != 0x11223344 {
+		t.Errorf("Request sent on channel %#x", got)
+	}
+}
+
+func TestHIDFraming(t *testing.T) {
+	dev, d := initialised(t)
+
+	// 57 bytes fit in the initialisation packet, and 59 in each
+	// continuation packet
+	msg := make([]byte, 200)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	res := make([]byte, 130)
+	for i := range res {
+		res[i] = byte(255 - i)
+	}
+	init := report(0x11, 0x22, 0x33, 0x44, 0x90, 0, 130)
+	copy(init[7:], res)
+	cont0 := report(0x11, 0x22, 0x33, 0x44, 0)
+	copy(cont0[5:], res[57:])
+	cont1 := report(0x11, 0x22, 0x33, 0x44, 1)
+	copy(cont1[5:], res[116:])
+
+	// A keepalive, a short packet and a packet for another channel are
+	// skipped
+	var presence int
+	dev.OnPresenceNeeded = func() { presence++ }
+	d.readCh <- report(0x11, 0x22, 0x33, 0x44, 0xbb, 0, 1, 2)
+	d.readCh <- []byte{0x11, 0x22, 0x33, 0x44, 0x90, 0, 1}
+	d.readCh <- report(0x55, 0x66, 0x77, 0x88, 0x90, 0, 1, 0)
+	d.readCh <- init
+	d.readCh <- cont0
+	d.readCh <- cont1
+
+	got, err := dev.CBOR(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, res) {
+		t.Errorf("Got response %x, want %x", got, res)
+	}
+	if presence != 1 {
+		t.Errorf("OnPresenceNeeded called %d times, want 1", presence)
+	}
+
+	want := [][]byte{
+		append(report(0x11, 0x22, 0x33, 0x44, 0x90, 0, 200)[:7], msg[:57]...),
+		append(report(0x11, 0x22, 0x33, 0x44, 0)[:5], msg[57:116]...),
+		append(report(0x11, 0x22, 0x33, 0x44, 1)[:5], msg[116:175]...),
+		append(report(0x11, 0x22, 0x33, 0x44, 2)[:5], msg[175:]...),
+	}
+	if len(d.written) != len(want) {
+		t.Fatalf("Wrote %d reports, want %d", len(d.written), len(want))
+	}
+	for i, w := range want {
+		w = append(w, make([]byte, 64-len(w))...)
+		if !bytes.Equal(d.written[i], w) {
+			t.Errorf("Report %d is %x, want %x", i, d.written[i], w)
+		}
+	}
+}
+
+func TestHIDError(t *testing.T) {
+	dev, d := initialised(t)
+
+	d.readCh <- report(0x11, 0x22, 0x33, 0x44, 0xbf, 0, 1, 0x06)
+	if _, err := dev.CBOR([]byte{0x04}); err == nil {
+		t.Error("Device error not reported")
+	}
+}
+
+func TestHIDAuthenticator(t *testing.T) {
+	auth := ctap2test.New("")
+	dev, err := ctap2.NewHIDDevice(&hid.DeviceInfo{}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// U2F messages are carried too
+	res, err := dev.Message([]byte{0, 3, 0, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, []byte{0x6d, 0x00}) {
+		t.Errorf("Got U2F response %x", res)
+	}
+}
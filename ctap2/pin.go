@@ -0,0 +1,124 @@
+package ctap2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// clientPIN subcommands
+const (
+	pinGetRetries      = 0x01
+	pinGetKeyAgreement = 0x02
+	pinGetPINToken     = 0x05
+)
+
+type clientPINRequest struct {
+	PINProtocol  uint     `cbor:"1,keyasint"`
+	SubCommand   uint     `cbor:"2,keyasint"`
+	KeyAgreement *COSEKey `cbor:"3,keyasint,omitempty"`
+	PINHashEnc   []byte   `cbor:"6,keyasint,omitempty"`
+}
+
+type clientPINResponse struct {
+	KeyAgreement *COSEKey `cbor:"1,keyasint,omitempty"`
+	PINToken     []byte   `cbor:"2,keyasint,omitempty"`
+	Retries      uint     `cbor:"3,keyasint,omitempty"`
+}
+
+// pinAuth computes the pinAuth parameter for a request under PIN protocol 1
+func pinAuth(token, data []byte) []byte {
+	mac := hmac.New(sha256.New, token)
+	mac.Write(data)
+	return mac.Sum(nil)[:16]
+}
+
+// PINRetries returns the number of PIN attempts remaining
+func (c *Client) PINRetries() (uint, error) {
+	var res clientPINResponse
+	err := c.call(cmdClientPIN, &clientPINRequest{
+		PINProtocol: 1,
+		SubCommand:  pinGetRetries,
+	}, &res)
+	return res.Retries, err
+}
+
+// sharedSecret performs PIN protocol 1 key agreement, returning our
+// public key and the shared secret
+func (c *Client) sharedSecret() (*COSEKey, []byte, error) {
+	var res clientPINResponse
+	err := c.call(cmdClientPIN, &clientPINRequest{
+		PINProtocol: 1,
+		SubCommand:  pinGetKeyAgreement,
+	}, &res)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.KeyAgreement == nil {
+		return nil, nil, errors.New("ctap2: no key agreement key")
+	}
+
+	pub, err := res.KeyAgreement.PublicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	authKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("ctap2: unexpected key agreement key type")
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x, _ := elliptic.P256().ScalarMult(authKey.X, authKey.Y, priv.D.Bytes())
+	z := make([]byte, 32)
+	x.FillBytes(z)
+	secret := sha256.Sum256(z)
+
+	return ecdhKey(&priv.PublicKey), secret[:], nil
+}
+
+// GetPINToken exchanges the PIN for a PIN token
+func (c *Client) GetPINToken(pin string) ([]byte, error) {
+	ourKey, secret, err := c.sharedSecret()
+	if err != nil {
+		return nil, errors.Wrap(err, "Agreeing PIN key")
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+
+	pinHash := sha256.Sum256([]byte(pin))
+	pinHashEnc := make([]byte, 16)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(pinHashEnc, pinHash[:16])
+
+	var res clientPINResponse
+	err = c.call(cmdClientPIN, &clientPINRequest{
+		PINProtocol:  1,
+		SubCommand:   pinGetPINToken,
+		KeyAgreement: ourKey,
+		PINHashEnc:   pinHashEnc,
+	}, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.PINToken) == 0 || len(res.PINToken)%aes.BlockSize != 0 {
+		return nil, errors.New("ctap2: invalid PIN token")
+	}
+
+	token := make([]byte, len(res.PINToken))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(token, res.PINToken)
+	return token, nil
+}
@@ -2,10 +2,16 @@
 package emissary
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"io"
 	"net"
+	"os"
+	"os/exec"
+	"time"
 
 	"github.com/erincandescent/ssh-emissary/composite"
+	"github.com/erincandescent/ssh-emissary/notify"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh/agent"
 	tilde "gopkg.in/mattes/go-expand-tilde.v1"
@@ -17,22 +23,54 @@ func Create(data []byte) (agent.Agent, error) {
 		return nil, err
 	}
 
+	if len(config.Notify) != 0 {
+		if err := notify.Configure(config.Notify); err != nil {
+			return nil, errors.Wrap(err, "Configuring notifications")
+		}
+	}
+
 	var backends []agent.Agent
 	for _, v := range config.Backends {
 		a, err := CreateBackend(v.Type, v.Params)
 		if err != nil {
+			closeBackends(backends)
 			return nil, errors.Wrapf(err, "Creating %s backend", v.Type)
 		}
 		backends = append(backends, a)
 	}
 
-	return composite.New(backends), nil
+	return &rootAgent{composite.New(backends), backends}, nil
+}
+
+// closeBackends closes the backends created before one failed
+func closeBackends(backends []agent.Agent) {
+	for _, a := range backends {
+		if c, ok := a.(io.Closer); ok {
+			c.Close()
+		}
+	}
 }
 
 type AgentFactory func(params json.RawMessage) (agent.Agent, error)
 
 type proxyConfig struct {
 	Socket string `json:"socket"`
+
+	// Address is the host:port of an agent listening with TLS, instead of
+	// Socket
+	Address string `json:"address"`
+	// Cert and Key are our client certificate and key
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// CA holds the certificates the server's certificate must be signed by
+	CA string `json:"ca"`
+	// ServerName is the name expected in the server's certificate, by
+	// default the host in Address
+	ServerName string `json:"server_name"`
+
+	// Command is run to reach the agent over its standard input and
+	// output, instead of Socket, e.g. ssh host ssh-emissary serve --stdio
+	Command []string `json:"command"`
 }
 
 func proxyFactory(params json.RawMessage) (agent.Agent, error) {
@@ -41,21 +79,127 @@ func proxyFactory(params json.RawMessage) (agent.Agent, error) {
 		return nil, err
 	}
 
+	if config.Address != "" {
+		return proxyTLS(config)
+	}
+	if len(config.Command) != 0 {
+		return proxyCommand(config.Command)
+	}
+
 	sock, err := tilde.Expand(config.Socket)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := net.Dial("unix", sock)
+	return &ReconnectingAgent{
+		Name: sock,
+		Dial: func() (io.ReadWriteCloser, error) {
+			return net.DialTimeout("unix", sock, DialTimeout)
+		},
+	}, nil
+}
+
+func proxyTLS(config proxyConfig) (agent.Agent, error) {
+	cert, err := loadKeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CA == "" {
+		return nil, errors.New("ca is required")
+	}
+	pool, err := loadCertPool(config.CA)
 	if err != nil {
 		return nil, err
 	}
 
-	return agent.NewClient(s), nil
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   config.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return &ReconnectingAgent{
+		Name: config.Address,
+		Dial: func() (io.ReadWriteCloser, error) {
+			// The timeout covers the handshake as well
+			dialer := &net.Dialer{Timeout: DialTimeout}
+			return tls.DialWithDialer(dialer, "tcp", config.Address, tlsConfig)
+		},
+	}, nil
+}
+
+func proxyCommand(command []string) (agent.Agent, error) {
+	name, err := tilde.Expand(command[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReconnectingAgent{
+		Name: name,
+		Dial: func() (io.ReadWriteCloser, error) {
+			return startCommand(name, command[1:])
+		},
+	}, nil
+}
+
+func startCommand(name string, args []string) (*commandConn, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "Running %s", name)
+	}
+
+	return &commandConn{stdout, stdin, cmd}, nil
+}
+
+// commandTimeout is how long a command is given to exit once its input
+// is closed
+const commandTimeout = 5 * time.Second
+
+// commandConn is a connection to the standard input and output of a
+// command
+type commandConn struct {
+	io.Reader
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+}
+
+func (self *commandConn) Write(b []byte) (int, error) {
+	return self.stdin.Write(b)
+}
+
+// Close closes the command's input, which it should exit upon, killing it
+// if it doesn't
+func (self *commandConn) Close() error {
+	self.stdin.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- self.cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(commandTimeout):
+		self.cmd.Process.Kill()
+		return <-done
+	}
 }
 
 var factories map[string]AgentFactory = map[string]AgentFactory{
 	"proxy": proxyFactory,
+	"env":   envFactory,
 }
 
 func CreateBackend(name string, params json.RawMessage) (agent.Agent, error) {
@@ -3,10 +3,45 @@ package emissary
 import "encoding/json"
 
 type Config struct {
-	Backends []Backend `json:"backends"`
+	Backends  []Backend        `json:"backends"`
+	Notify    json.RawMessage  `json:"notify"`
+	Listeners []ListenerConfig `json:"listeners"`
 }
 
 type Backend struct {
 	Type   string          `json:"type"`
 	Params json.RawMessage `json:"params"`
 }
+
+// ListenerConfig declares a listener in addition to the agent socket
+type ListenerConfig struct {
+	// Type is "tls" or "abstract"
+	Type string `json:"type"`
+	// Address is host:port for tls, or the name of an abstract socket
+	Address string `json:"address"`
+
+	// Cert and Key are the server certificate and key for tls
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// ClientCA holds the certificates client certificates must be signed by
+	ClientCA string `json:"client_ca"`
+	// Clients maps client certificates to the keys they may use
+	Clients []ClientConfig `json:"clients"`
+}
+
+// ClientConfig chooses the keys offered to TLS clients whose certificate
+// subject matches
+type ClientConfig struct {
+	// Subject is a glob pattern matched against the common name
+	Subject string `json:"subject"`
+	KeyFilter
+}
+
+// KeyFilter restricts which keys are offered. An empty filter offers all
+// keys
+type KeyFilter struct {
+	// Keys lists SHA256 key fingerprints, as printed by ssh-add -l
+	Keys []string `json:"keys"`
+	// Comments lists glob patterns matched against key comments
+	Comments []string `json:"comments"`
+}
@@ -0,0 +1,130 @@
+package emissary
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errNoAgent = errors.New("SSH_AUTH_SOCK is unset")
+
+// loopError refuses an agent which leads back to us
+type loopError struct {
+	sock string
+}
+
+func (self *loopError) Error() string {
+	return "Refusing to use SSH_AUTH_SOCK " + self.sock + ", which leads back to this agent"
+}
+
+// envAgent proxies to the agent in SSH_AUTH_SOCK when we started. As
+// SSH_AUTH_SOCK may be our own socket, or lead back to it, the agent is
+// checked for loops each time we connect, which is once we are serving
+// requests. Once a loop has been found, the agent is refused for good
+type envAgent struct {
+	*ReconnectingAgent
+	sock string
+
+	mu sync.Mutex
+	// refused is set once a loop has been found
+	refused error
+}
+
+var _ agent.ExtendedAgent = &envAgent{}
+
+func envFactory(params json.RawMessage) (agent.Agent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		log.Print("SSH_AUTH_SOCK is unset; the env backend has no keys")
+	}
+	return newEnvAgent(sock), nil
+}
+
+func newEnvAgent(sock string) *envAgent {
+	self := &envAgent{sock: sock}
+	self.ReconnectingAgent = &ReconnectingAgent{
+		Name: "SSH_AUTH_SOCK",
+		Dial: self.connect,
+	}
+	return self
+}
+
+// connect connects to the agent, and checks that it doesn't lead back to us
+func (self *envAgent) connect() (io.ReadWriteCloser, error) {
+	if self.sock == "" {
+		return nil, errNoAgent
+	}
+	if err := self.isRefused(); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", self.sock, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Agents other than ssh-emissary don't support loop checks, and don't
+	// proxy to us
+	loop, err := CheckLoop(agent.NewClient(conn), []string{InstanceID})
+	if err != nil && err != agent.ErrExtensionUnsupported {
+		conn.Close()
+		return nil, errors.Wrap(err, "Checking for loops")
+	}
+	if loop {
+		conn.Close()
+		return nil, self.refuse()
+	}
+	return conn, nil
+}
+
+func (self *envAgent) isRefused() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.refused
+}
+
+func (self *envAgent) refuse() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.refused = &loopError{self.sock}
+	return self.refused
+}
+
+// forwardLoopCheck passes a loop check on over a connection of its own.
+// This is used while connecting, when the check may come from the agent we
+// are connecting to, which would otherwise wait for itself
+func (self *envAgent) forwardLoopCheck(contents []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", self.sock, DialTimeout)
+	if err != nil {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).Extension(LoopExtension, contents)
+}
+
+// List lists no keys if there is no agent or it has been refused, as
+// that has already been logged
+func (self *envAgent) List() ([]*agent.Key, error) {
+	keys, err := self.ReconnectingAgent.List()
+	cause := errors.Cause(err)
+	if _, ok := cause.(*loopError); ok || cause == errNoAgent {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// Extension passes the extension on. If there is no agent, or it has been
+// refused, it supports no extensions; in particular we pass nothing on, so
+// can't lead to a loop
+func (self *envAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == LoopExtension && self.sock != "" && self.isConnecting() {
+		return self.forwardLoopCheck(contents)
+	}
+	return self.ReconnectingAgent.Extension(extensionType, contents)
+}
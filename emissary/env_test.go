@@ -0,0 +1,214 @@
+package emissary
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/composite"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serve serves a on sock until the listener is closed
+func serve(t *testing.T, sock string, a agent.Agent) net.Listener {
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(a, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func dialCheckLoop(sock string, path []string) (bool, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	return CheckLoop(agent.NewClient(conn), path)
+}
+
+// peerAgent stands in for another instance, "peer", whose env backend is
+// our socket and which is connecting to it at the same time as we connect
+// to it: before answering a loop check it makes its own
+type peerAgent struct {
+	agent.ExtendedAgent
+	ourSock string
+	ownLoop chan bool
+}
+
+func (self *peerAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	var req LoopRequest
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, err
+	}
+
+	loop := false
+	for _, id := range req.Path {
+		if id == "peer" {
+			loop = true
+		}
+	}
+	if !loop {
+		own, err := dialCheckLoop(self.ourSock, []string{"peer"})
+		if err != nil {
+			return nil, err
+		}
+		self.ownLoop <- own
+
+		if loop, err = dialCheckLoop(self.ourSock, append(req.Path, "peer")); err != nil {
+			return nil, err
+		}
+	}
+	return lib.ExtensionResponse(ssh.Marshal(&LoopResponse{loop})), nil
+}
+
+func TestEnvMutualLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emissary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ourSock := filepath.Join(dir, "ours.sock")
+	peerSock := filepath.Join(dir, "peer.sock")
+
+	env := newEnvAgent(peerSock)
+	defer env.Close()
+	root := &rootAgent{composite.New([]agent.Agent{env}), []agent.Agent{env}}
+	l := serve(t, ourSock, root)
+	defer l.Close()
+
+	peer := &peerAgent{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		ourSock:       ourSock,
+		ownLoop:       make(chan bool, 1),
+	}
+	pl := serve(t, peerSock, peer)
+	defer pl.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		keys, err := env.List()
+		if err == nil && len(keys) != 0 {
+			t.Errorf("Listed %d keys through a loop", len(keys))
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Deadlocked checking for loops")
+	}
+
+	if _, ok := env.isRefused().(*loopError); !ok {
+		t.Errorf("Peer wasn't refused: %v", env.isRefused())
+	}
+	if !<-peer.ownLoop {
+		t.Error("Peer's own check found no loop")
+	}
+}
+
+// serveStoppable serves a on sock; stop closes the listener and every
+// connection, as if the agent had exited
+func serveStoppable(t *testing.T, sock string, a agent.Agent) (stop func()) {
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go agent.ServeAgent(a, conn)
+		}
+	}()
+
+	return func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func newKeyring(t *testing.T) agent.Agent {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func TestEnvRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emissary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+
+	env := newEnvAgent(sock)
+	defer env.Close()
+
+	stop := serveStoppable(t, sock, newKeyring(t))
+	keys, err := env.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("List returned %d keys, %v", len(keys), err)
+	}
+	first := keys[0].Blob
+
+	stop()
+	os.Remove(sock)
+	stop = serveStoppable(t, sock, newKeyring(t))
+	defer stop()
+
+	// The old connection is found to have gone, then replaced
+	if _, err := env.List(); err == nil {
+		t.Fatal("List succeeded on a closed connection")
+	}
+	keys, err = env.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("List after restarting returned %d keys, %v", len(keys), err)
+	}
+	if bytes.Equal(keys[0].Blob, first) {
+		t.Error("Listed the old agent's key after restarting")
+	}
+}
@@ -0,0 +1,166 @@
+package emissary
+
+import (
+	"bytes"
+	"path"
+	"sync"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var errNotPermitted = errors.New("Not permitted for this client")
+
+// restricted returns whether the filter hides any keys
+func (self *KeyFilter) restricted() bool {
+	return len(self.Keys) != 0 || len(self.Comments) != 0
+}
+
+func (self *KeyFilter) allows(key *agent.Key) bool {
+	if !self.restricted() {
+		return true
+	}
+
+	if len(self.Keys) != 0 {
+		if pub, err := ssh.ParsePublicKey(key.Blob); err == nil {
+			fp := ssh.FingerprintSHA256(pub)
+			for _, k := range self.Keys {
+				if k == fp {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, pattern := range self.Comments {
+		if ok, _ := path.Match(pattern, key.Comment); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAgent offers the keys of an agent which a filter allows, to a
+// client which may not change the agent
+type filterAgent struct {
+	agent  agent.Agent
+	filter *KeyFilter
+
+	mu      sync.Mutex
+	allowed [][]byte
+}
+
+var _ agent.ExtendedAgent = &filterAgent{}
+var _ lib.SessionAgent = &filterAgent{}
+
+func newFilterAgent(a agent.Agent, filter *KeyFilter) *filterAgent {
+	return &filterAgent{agent: a, filter: filter}
+}
+
+func (self *filterAgent) List() ([]*agent.Key, error) {
+	keys, err := self.agent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []*agent.Key
+	var allowed [][]byte
+	for _, k := range keys {
+		if self.filter.allows(k) {
+			filtered = append(filtered, k)
+			allowed = append(allowed, k.Blob)
+		}
+	}
+
+	self.mu.Lock()
+	self.allowed = allowed
+	self.mu.Unlock()
+	return filtered, nil
+}
+
+func (self *filterAgent) isAllowed(blob []byte) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, b := range self.allowed {
+		if bytes.Equal(b, blob) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKey returns an error unless key is one the client may use, listing
+// the keys again if it hasn't been seen
+func (self *filterAgent) checkKey(key ssh.PublicKey) error {
+	if !self.filter.restricted() {
+		return nil
+	}
+
+	blob := key.Marshal()
+	if self.isAllowed(blob) {
+		return nil
+	}
+	if _, err := self.List(); err != nil {
+		return err
+	}
+	if self.isAllowed(blob) {
+		return nil
+	}
+	return errNotPermitted
+}
+
+func (self *filterAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return self.SignWithFlags(key, data, 0)
+}
+
+func (self *filterAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return self.SignInSession(nil, key, data, flags)
+}
+
+func (self *filterAgent) SignInSession(s *lib.Session, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := self.checkKey(key); err != nil {
+		return nil, err
+	}
+	return lib.SignInSession(self.agent, s, key, data, flags)
+}
+
+func (self *filterAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return self.ExtensionInSession(nil, extensionType, contents)
+}
+
+// ExtensionInSession passes extensions other than loop checks on only for
+// clients which may use every key, as we can't tell which keys an
+// extension uses
+func (self *filterAgent) ExtensionInSession(s *lib.Session, extensionType string, contents []byte) ([]byte, error) {
+	if self.filter.restricted() && extensionType != LoopExtension {
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return lib.ExtensionInSession(self.agent, s, extensionType, contents)
+}
+
+func (self *filterAgent) Add(key agent.AddedKey) error {
+	return errNotPermitted
+}
+
+func (self *filterAgent) Remove(key ssh.PublicKey) error {
+	return errNotPermitted
+}
+
+func (self *filterAgent) RemoveAll() error {
+	return errNotPermitted
+}
+
+func (self *filterAgent) Lock(passphrase []byte) error {
+	return errNotPermitted
+}
+
+func (self *filterAgent) Unlock(passphrase []byte) error {
+	return errNotPermitted
+}
+
+func (self *filterAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errNotPermitted
+}
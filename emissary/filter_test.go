@@ -0,0 +1,123 @@
+package emissary
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// extensionAgent is a keyring which answers every extension
+type extensionAgent struct {
+	agent.ExtendedAgent
+}
+
+func (self *extensionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return []byte("ok"), nil
+}
+
+// filterKeyring returns a keyring holding a key for each comment
+func filterKeyring(t *testing.T, comments ...string) (agent.Agent, map[string]ssh.PublicKey) {
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	pubs := make(map[string]ssh.PublicKey)
+	for _, c := range comments {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: c}); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs[c] = signer.PublicKey()
+	}
+	return &extensionAgent{keyring}, pubs
+}
+
+func TestFilterAgent(t *testing.T) {
+	backend, pubs := filterKeyring(t, "work", "home", "other")
+
+	tests := []struct {
+		name       string
+		filter     KeyFilter
+		allowed    []string
+		extensions bool
+	}{
+		{"unrestricted", KeyFilter{}, []string{"work", "home", "other"}, true},
+		{"comment", KeyFilter{Comments: []string{"wo*"}}, []string{"work"}, false},
+		{"fingerprint", KeyFilter{Keys: []string{ssh.FingerprintSHA256(pubs["home"])}}, []string{"home"}, false},
+		{"both", KeyFilter{
+			Keys:     []string{ssh.FingerprintSHA256(pubs["home"])},
+			Comments: []string{"work"},
+		}, []string{"work", "home"}, false},
+		{"nothing matches", KeyFilter{Comments: []string{"nothing"}}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := make(map[string]bool)
+			for _, c := range tt.allowed {
+				allowed[c] = true
+			}
+
+			// Signing is checked even if the client hasn't listed keys
+			a := newFilterAgent(backend, &tt.filter)
+			for c, pub := range pubs {
+				sig, err := a.Sign(pub, []byte("data"))
+				if allowed[c] {
+					if err != nil {
+						t.Errorf("Signing with %s: %s", c, err)
+					} else if err := pub.Verify([]byte("data"), sig); err != nil {
+						t.Errorf("Signature with %s doesn't verify: %s", c, err)
+					}
+				} else if err != errNotPermitted {
+					t.Errorf("Signing with %s returned %v, want refusal", c, err)
+				}
+			}
+
+			keys, err := a.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(tt.allowed) {
+				t.Errorf("Listed %d keys, want %d", len(keys), len(tt.allowed))
+			}
+			for _, k := range keys {
+				if !allowed[k.Comment] {
+					t.Errorf("Listed %s", k.Comment)
+				}
+			}
+
+			_, err = a.Extension("test@e43.eu", nil)
+			if tt.extensions && err != nil {
+				t.Errorf("Extension refused: %s", err)
+			} else if !tt.extensions && err != agent.ErrExtensionUnsupported {
+				t.Errorf("Extension returned %v, want ErrExtensionUnsupported", err)
+			}
+
+			// Loop checks are always passed on
+			if _, err := a.Extension(LoopExtension, nil); err != nil {
+				t.Errorf("Loop check refused: %s", err)
+			}
+
+			_, priv, _ := ed25519.GenerateKey(rand.Reader)
+			if err := a.Add(agent.AddedKey{PrivateKey: priv}); err != errNotPermitted {
+				t.Errorf("Add returned %v", err)
+			}
+			if err := a.Remove(pubs["work"]); err != errNotPermitted {
+				t.Errorf("Remove returned %v", err)
+			}
+			if err := a.RemoveAll(); err != errNotPermitted {
+				t.Errorf("RemoveAll returned %v", err)
+			}
+			if err := a.Lock([]byte("x")); err != errNotPermitted {
+				t.Errorf("Lock returned %v", err)
+			}
+		})
+	}
+}
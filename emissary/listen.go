@@ -0,0 +1,185 @@
+package emissary
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+)
+
+// handshakeTimeout limits how long a TLS client may take to identify itself
+const handshakeTimeout = 10 * time.Second
+
+// Listener is a listener declared in the configuration. Before serving a
+// connection accepted from it, Authorize must be called
+type Listener struct {
+	net.Listener
+	config ListenerConfig
+}
+
+// CreateListeners creates the listeners declared in the configuration
+func CreateListeners(data []byte) ([]*Listener, error) {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	var listeners []*Listener
+	for _, lc := range config.Listeners {
+		l, err := listen(lc)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "Listening on %s %s", lc.Type, lc.Address)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func listen(config ListenerConfig) (*Listener, error) {
+	if config.Address == "" {
+		return nil, errors.New("No address given")
+	}
+
+	switch config.Type {
+	case "tls":
+		tlsConfig, err := serverTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		l, err := tls.Listen("tcp", config.Address, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &Listener{l, config}, nil
+
+	case "abstract":
+		l, err := net.Listen("unix", "@"+config.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &Listener{l, config}, nil
+
+	default:
+		return nil, errors.Errorf("Unknown listener type %s", config.Type)
+	}
+}
+
+// Remote returns whether connections from this listener come from other
+// hosts, and so should be treated as forwarded
+func (self *Listener) Remote() bool {
+	return self.config.Type == "tls"
+}
+
+// Authorize checks the client of conn, and returns the agent it may use
+func (self *Listener) Authorize(conn net.Conn, a agent.Agent) (agent.Agent, error) {
+	switch self.config.Type {
+	case "tls":
+		return self.authorizeTLS(conn, a)
+
+	case "abstract":
+		// Abstract sockets have no permissions, so anybody in our network
+		// namespace may connect
+		uid, err := peerUid(conn)
+		if err != nil {
+			return nil, errors.Wrap(err, "Getting peer credentials")
+		}
+		if uid != os.Getuid() {
+			return nil, errors.Errorf("Refusing connection from uid %d", uid)
+		}
+		return a, nil
+	}
+	return nil, errors.Errorf("Unknown listener type %s", self.config.Type)
+}
+
+func (self *Listener) authorizeTLS(conn net.Conn, a agent.Agent) (agent.Agent, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, errors.New("Not a TLS connection")
+	}
+
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "TLS handshake")
+	}
+	tc.SetDeadline(time.Time{})
+
+	// The handshake requires a certificate signed by the client CA
+	cert := tc.ConnectionState().PeerCertificates[0]
+	name := cert.Subject.CommonName
+	for i := range self.config.Clients {
+		client := &self.config.Clients[i]
+		if ok, _ := path.Match(client.Subject, name); ok {
+			return newFilterAgent(a, &client.KeyFilter), nil
+		}
+	}
+	return nil, errors.Errorf("No client matches certificate %q", name)
+}
+
+func serverTLSConfig(config ListenerConfig) (*tls.Config, error) {
+	cert, err := loadKeyPair(config.Cert, config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ClientCA == "" {
+		return nil, errors.New("client_ca is required")
+	}
+	pool, err := loadCertPool(config.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certFile, err := tilde.Expand(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyFile, err = tilde.Expand(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrapf(err, "Loading certificate %s", certFile)
+	}
+	return cert, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	file, err := tilde.Expand(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("No certificates found in %s", file)
+	}
+	return pool, nil
+}
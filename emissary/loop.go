@@ -0,0 +1,96 @@
+package emissary
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/erincandescent/ssh-emissary/composite"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// LoopExtension finds loops of agents which proxy to each other. Each
+// agent adds its instance ID to the request's path and passes it to its
+// backends; an agent which finds its own ID in the path reports a loop
+const LoopExtension = "loop-check@e43.eu"
+
+type LoopRequest struct {
+	// Path holds the instance IDs of the agents the request has passed
+	// through
+	Path []string
+}
+
+type LoopResponse struct {
+	Loop bool
+}
+
+// InstanceID identifies this process in loop checks
+var InstanceID = newInstanceID()
+
+func newInstanceID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// CheckLoop asks a whether passing a request through the agents in path
+// and then a leads back to one of them
+func CheckLoop(a agent.Agent, path []string) (bool, error) {
+	res, err := lib.CallExtension(a, LoopExtension, ssh.Marshal(&LoopRequest{path}))
+	if err != nil {
+		return false, err
+	}
+
+	var resp LoopResponse
+	if err := ssh.Unmarshal(res, &resp); err != nil {
+		return false, errors.Wrap(err, "Parsing loop-check response")
+	}
+	return resp.Loop, nil
+}
+
+// rootAgent is the agent created from the configuration, which answers
+// loop checks on behalf of its backends
+type rootAgent struct {
+	*composite.CompositeAgent
+	backends []agent.Agent
+}
+
+func (self *rootAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return self.ExtensionInSession(nil, extensionType, contents)
+}
+
+func (self *rootAgent) ExtensionInSession(s *lib.Session, extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != LoopExtension {
+		return self.CompositeAgent.ExtensionInSession(s, extensionType, contents)
+	}
+
+	var req LoopRequest
+	if err := ssh.Unmarshal(contents, &req); err != nil {
+		return nil, errors.Wrap(err, "Parsing loop-check request")
+	}
+
+	loop := false
+	for _, id := range req.Path {
+		if id == InstanceID {
+			loop = true
+		}
+	}
+
+	if !loop {
+		path := append(req.Path, InstanceID)
+		for _, b := range self.backends {
+			// Backends which don't support the extension don't lead
+			// anywhere
+			if l, err := CheckLoop(b, path); err == nil && l {
+				loop = true
+				break
+			}
+		}
+	}
+
+	return lib.ExtensionResponse(ssh.Marshal(&LoopResponse{loop})), nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package emissary
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// peerUid is only implemented on Linux, which is the only platform with
+// abstract sockets
+func peerUid(conn net.Conn) (int, error) {
+	return 0, errors.New("Peer credentials are not supported on this platform")
+}
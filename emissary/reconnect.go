@@ -0,0 +1,265 @@
+package emissary
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	// DialTimeout limits how long connecting to another agent takes
+	DialTimeout = 15 * time.Second
+	// RetryDelay is how long we wait before connecting again after failing
+	RetryDelay = 30 * time.Second
+)
+
+// ReconnectingAgent is a client of another agent, reached by Dial. It
+// connects when first used, and again once the connection fails. After
+// failing to connect, requests fail for RetryDelay before it tries again.
+//
+// Dial is called without any lock held, so it may itself make requests
+// which lead back to us; a loop check arriving while it is in progress
+// is answered as if we proxy to nothing
+type ReconnectingAgent struct {
+	// Name describes the agent in errors and logs
+	Name string
+	Dial func() (io.ReadWriteCloser, error)
+
+	mu         sync.Mutex
+	conn       *failConn
+	agent      agent.ExtendedAgent
+	connecting chan struct{}
+	lastErr    error
+	retryAt    time.Time
+	closed     bool
+}
+
+var _ agent.ExtendedAgent = &ReconnectingAgent{}
+
+// failConn is a connection which remembers whether it has failed
+type failConn struct {
+	io.ReadWriteCloser
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func (c *failConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if err != nil {
+		c.fail()
+	}
+	return n, err
+}
+
+func (c *failConn) Write(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(b)
+	if err != nil {
+		c.fail()
+	}
+	return n, err
+}
+
+func (c *failConn) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = true
+}
+
+func (c *failConn) hasFailed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failed
+}
+
+// isConnecting returns whether Dial is in progress
+func (self *ReconnectingAgent) isConnecting() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.connecting != nil
+}
+
+// get returns the connection and a client using it, connecting if
+// necessary
+func (self *ReconnectingAgent) get() (*failConn, agent.ExtendedAgent, error) {
+	self.mu.Lock()
+	for self.connecting != nil {
+		// Wait for the connection already being made
+		connecting := self.connecting
+		self.mu.Unlock()
+		<-connecting
+		self.mu.Lock()
+	}
+
+	switch {
+	case self.closed:
+		self.mu.Unlock()
+		return nil, nil, errors.Errorf("%s is closed", self.Name)
+	case self.agent != nil:
+		conn, a := self.conn, self.agent
+		self.mu.Unlock()
+		return conn, a, nil
+	case time.Now().Before(self.retryAt):
+		err := self.lastErr
+		self.mu.Unlock()
+		return nil, nil, err
+	}
+
+	connecting := make(chan struct{})
+	self.connecting = connecting
+	self.mu.Unlock()
+
+	rwc, err := self.Dial()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.connecting = nil
+	close(connecting)
+
+	if err != nil {
+		self.lastErr = errors.Wrapf(err, "Connecting to %s", self.Name)
+		self.retryAt = time.Now().Add(RetryDelay)
+		log.Print(self.lastErr)
+		return nil, nil, self.lastErr
+	}
+	if self.closed {
+		go rwc.Close()
+		return nil, nil, errors.Errorf("%s is closed", self.Name)
+	}
+
+	log.Printf("Connected to %s", self.Name)
+	self.conn = &failConn{ReadWriteCloser: rwc}
+	self.agent = agent.NewClient(self.conn)
+	return self.conn, self.agent, nil
+}
+
+// do calls f with the agent, connecting to it if necessary. If the
+// connection fails, it is closed so that the next request reconnects
+func (self *ReconnectingAgent) do(f func(a agent.ExtendedAgent) error) error {
+	conn, a, err := self.get()
+	if err != nil {
+		return err
+	}
+
+	err = f(a)
+	if err != nil && conn.hasFailed() {
+		log.Printf("Lost connection to %s: %s", self.Name, err)
+		self.drop(conn)
+	}
+	return err
+}
+
+// drop forgets conn, if it is still the current connection, and closes it
+func (self *ReconnectingAgent) drop(conn *failConn) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.conn == conn {
+		self.conn = nil
+		self.agent = nil
+		// Closing a command may wait for it to exit
+		go conn.Close()
+	}
+}
+
+func (self *ReconnectingAgent) List() (keys []*agent.Key, err error) {
+	err = self.do(func(a agent.ExtendedAgent) (err error) {
+		keys, err = a.List()
+		return
+	})
+	return
+}
+
+func (self *ReconnectingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return self.SignWithFlags(key, data, 0)
+}
+
+func (self *ReconnectingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	err = self.do(func(a agent.ExtendedAgent) (err error) {
+		sig, err = a.SignWithFlags(key, data, flags)
+		return
+	})
+	return
+}
+
+// Extension passes the extension on. If the agent can't be reached, it
+// supports no extensions
+func (self *ReconnectingAgent) Extension(extensionType string, contents []byte) (res []byte, err error) {
+	if extensionType == LoopExtension && self.isConnecting() {
+		// The check may be from the agent we are connecting to, which
+		// can't lead back to us through a connection not yet made
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	conn, a, err := self.get()
+	if err != nil {
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	res, err = a.Extension(extensionType, contents)
+	if err != nil && conn.hasFailed() {
+		log.Printf("Lost connection to %s: %s", self.Name, err)
+		self.drop(conn)
+		return nil, agent.ErrExtensionUnsupported
+	}
+	return res, err
+}
+
+func (self *ReconnectingAgent) Add(key agent.AddedKey) error {
+	return self.do(func(a agent.ExtendedAgent) error {
+		return a.Add(key)
+	})
+}
+
+func (self *ReconnectingAgent) Remove(key ssh.PublicKey) error {
+	return self.do(func(a agent.ExtendedAgent) error {
+		return a.Remove(key)
+	})
+}
+
+func (self *ReconnectingAgent) RemoveAll() error {
+	return self.do(func(a agent.ExtendedAgent) error {
+		return a.RemoveAll()
+	})
+}
+
+func (self *ReconnectingAgent) Lock(passphrase []byte) error {
+	return self.do(func(a agent.ExtendedAgent) error {
+		return a.Lock(passphrase)
+	})
+}
+
+func (self *ReconnectingAgent) Unlock(passphrase []byte) error {
+	return self.do(func(a agent.ExtendedAgent) error {
+		return a.Unlock(passphrase)
+	})
+}
+
+func (self *ReconnectingAgent) Signers() (signers []ssh.Signer, err error) {
+	err = self.do(func(a agent.ExtendedAgent) (err error) {
+		signers, err = a.Signers()
+		return
+	})
+	return
+}
+
+// Close closes the connection, and stops any more being made
+func (self *ReconnectingAgent) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.closed = true
+	if self.conn == nil {
+		return nil
+	}
+
+	err := self.conn.Close()
+	self.conn = nil
+	self.agent = nil
+	return err
+}
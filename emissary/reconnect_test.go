@@ -0,0 +1,137 @@
+package emissary
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveKeyring serves a keyring holding one key on sock, closing each
+// connection after one request
+func serveKeyring(t *testing.T, sock string) net.Listener {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// One request, then hang up
+				agent.ServeAgent(keyring, &oneRequest{Conn: conn})
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// oneRequest ends the connection once a reply has been written
+type oneRequest struct {
+	net.Conn
+	replied bool
+}
+
+func (c *oneRequest) Read(b []byte) (int, error) {
+	if c.replied {
+		return 0, io.EOF
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *oneRequest) Write(b []byte) (int, error) {
+	// The reply's length is written first, then its body
+	c.replied = len(b) > 4
+	return c.Conn.Write(b)
+}
+
+func TestReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emissary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "agent.sock")
+
+	dials := 0
+	a := &ReconnectingAgent{
+		Name: sock,
+		Dial: func() (io.ReadWriteCloser, error) {
+			dials++
+			return net.DialTimeout("unix", sock, DialTimeout)
+		},
+	}
+	defer a.Close()
+
+	// Nothing is listening yet, so connecting fails and isn't retried
+	// at once
+	if _, err := a.List(); err == nil {
+		t.Fatal("List succeeded with no agent")
+	}
+	if _, err := a.Extension(LoopExtension, nil); err != agent.ErrExtensionUnsupported {
+		t.Errorf("Extension returned %v with no agent, want ErrExtensionUnsupported", err)
+	}
+	if dials != 1 {
+		t.Fatalf("Dialled %d times, want 1", dials)
+	}
+
+	l := serveKeyring(t, sock)
+	defer l.Close()
+	a.retryAt = a.retryAt.Add(-RetryDelay)
+
+	keys, err := a.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("List returned %d keys, %v", len(keys), err)
+	}
+
+	// The server hung up after that, so this fails and the connection is
+	// replaced
+	if _, err := a.List(); err == nil {
+		t.Fatal("List succeeded on a closed connection")
+	}
+	keys, err = a.List()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("List after reconnecting returned %d keys, %v", len(keys), err)
+	}
+	if dials != 3 {
+		t.Errorf("Dialled %d times, want 3", dials)
+	}
+}
+
+func TestCreateClosesBackends(t *testing.T) {
+	var created []*ReconnectingAgent
+	RegisterBackend("test-closed", func(json.RawMessage) (agent.Agent, error) {
+		a := &ReconnectingAgent{Name: "test"}
+		created = append(created, a)
+		return a, nil
+	})
+	defer delete(factories, "test-closed")
+
+	_, err := Create([]byte(`{"backends": [{"type": "test-closed"}, {"type": "missing"}]}`))
+	if err == nil {
+		t.Fatal("Create succeeded with an unknown backend")
+	}
+	if len(created) != 1 || !created[0].closed {
+		t.Error("Backend created before the failure wasn't closed")
+	}
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+)
+
+// xdgDir returns $<env>/ssh-emissary, falling back to ~/<fallback>/ssh-emissary,
+// creating it if necessary
+func xdgDir(env, fallback string) (string, error) {
+	base := os.Getenv(env)
+	if base == "" {
+		home, err := tilde.Home()
+		if err != nil {
+			return "", err
+		}
+		base = path.Join(home, fallback)
+	}
+
+	dir := path.Join(base, "ssh-emissary")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "Creating %s", dir)
+	}
+	return dir, nil
+}
+
+// StateDir returns the directory persistent state is stored in
+func StateDir() (string, error) {
+	return xdgDir("XDG_STATE_HOME", ".local/state")
+}
+
+// ConfigDir returns the directory configuration is stored in
+func ConfigDir() (string, error) {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+// RuntimeDir returns the directory runtime files such as sockets and
+// pidfiles are kept in: $XDG_RUNTIME_DIR/ssh-emissary, or a per-user
+// directory in the system temporary directory
+func RuntimeDir() (string, error) {
+	if os.Getenv("XDG_RUNTIME_DIR") != "" {
+		return xdgDir("XDG_RUNTIME_DIR", "")
+	}
+
+	// Anybody can create this before us, so make sure we own it
+	dir := path.Join(os.TempDir(), fmt.Sprintf("ssh-emissary-%d", os.Getuid()))
+	if _, err := MakePrivateDir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// DefaultSocket returns the well known socket path the agent listens on
+// by default
+func DefaultSocket() (string, error) {
+	dir, err := RuntimeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "agent.sock"), nil
+}
+
+// CheckPrivateDir checks that dir is suitable for holding private sockets:
+// a directory (not a symlink) owned by us which nobody else may write to.
+// If it is merely readable by others, a warning is returned instead
+func CheckPrivateDir(dir string) (warning string, err error) {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !fi.IsDir() {
+		return "", errors.Errorf("%s is not a directory", dir)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return "", errors.Errorf("%s is owned by another user (uid %d)", dir, st.Uid)
+	}
+
+	mode := fi.Mode().Perm()
+	if mode&0022 != 0 {
+		return "", errors.Errorf("%s is writable by other users (mode %04o)", dir, mode)
+	}
+	if mode&0077 != 0 {
+		return fmt.Sprintf("%s is accessible by other users (mode %04o)", dir, mode), nil
+	}
+	return "", nil
+}
+
+// MakePrivateDir creates dir with mode 0700 if it doesn't exist, then
+// checks it as CheckPrivateDir does
+func MakePrivateDir(dir string) (warning string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrapf(err, "Creating %s", dir)
+	}
+	return CheckPrivateDir(dir)
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSH_AGENT_SUCCESS, which prefixes successful extension responses
+const agentSuccess = 6
+
+// ExtensionResponse wraps an extension response payload for returning
+// from agent.ExtendedAgent.Extension
+func ExtensionResponse(payload []byte) []byte {
+	return append([]byte{agentSuccess}, payload...)
+}
+
+// ParseExtensionResponse extracts the payload from an extension response
+func ParseExtensionResponse(res []byte) ([]byte, error) {
+	if len(res) == 0 || res[0] != agentSuccess {
+		return nil, errors.New("Unexpected extension response")
+	}
+	return res[1:], nil
+}
+
+// CallExtension calls an extension on an agent, returning
+// agent.ErrExtensionUnsupported if the agent doesn't support extensions
+func CallExtension(a agent.Agent, extensionType string, contents []byte) ([]byte, error) {
+	ea, ok := a.(agent.ExtendedAgent)
+	if !ok {
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	res, err := ea.Extension(extensionType, contents)
+	if err != nil {
+		return nil, err
+	}
+	return ParseExtensionResponse(res)
+}
@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"github.com/foxcpp/go-assuan/pinentry"
+)
+
+// PinPrompt asks the user for secrets using pinentry. The pinentry
+// process is launched on first use and kept until Close is called
+type PinPrompt struct {
+	pinent *pinentry.Client
+}
+
+func (self *PinPrompt) launch() error {
+	if self.pinent != nil {
+		return nil
+	}
+
+	pinent, err := pinentry.Launch()
+	if err != nil {
+		return err
+	}
+	self.pinent = pinent
+	return nil
+}
+
+// GetSecret prompts the user for a secret
+func (self *PinPrompt) GetSecret(desc, prompt string) ([]byte, error) {
+	if err := self.launch(); err != nil {
+		return nil, err
+	}
+
+	self.pinent.SetDesc(desc)
+	self.pinent.SetPrompt(prompt)
+	pin, err := self.pinent.GetPIN()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(pin), nil
+}
+
+// Retry shows a message explaining why the user is being asked again
+func (self *PinPrompt) Retry(msg string) {
+	if self.pinent != nil {
+		self.pinent.SetRepeatPrompt(msg)
+	}
+}
+
+func (self *PinPrompt) Close() {
+	if self.pinent != nil {
+		self.pinent.Shutdown()
+		self.pinent = nil
+	}
+}
@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SessionBindExtension is sent by OpenSSH (8.9 and later) to tell the agent
+// which SSH session a connection belongs to, and whether it was forwarded
+const SessionBindExtension = "session-bind@openssh.com"
+
+type sessionBindRequest struct {
+	HostKey      []byte
+	SessionID    []byte
+	Signature    []byte
+	IsForwarding bool
+}
+
+// Session records what we know about the client of one agent connection
+type Session struct {
+	mu        sync.Mutex
+	forwarded bool
+}
+
+// Forwarded returns whether the client has said this connection is
+// forwarded from another host. A nil Session is a local connection
+func (self *Session) Forwarded() bool {
+	if self == nil {
+		return false
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.forwarded
+}
+
+// SessionAgent is implemented by agents whose behaviour depends upon the
+// connection a request arrived on
+type SessionAgent interface {
+	SignInSession(s *Session, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error)
+	ExtensionInSession(s *Session, extensionType string, contents []byte) ([]byte, error)
+}
+
+// SignInSession signs using a, passing the session and flags on if it
+// supports them
+func SignInSession(a agent.Agent, s *Session, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if sa, ok := a.(SessionAgent); ok {
+		return sa.SignInSession(s, key, data, flags)
+	}
+	if ea, ok := a.(agent.ExtendedAgent); ok {
+		return ea.SignWithFlags(key, data, flags)
+	}
+	return a.Sign(key, data)
+}
+
+// ExtensionInSession calls an extension on a, passing the session on if it
+// supports it
+func ExtensionInSession(a agent.Agent, s *Session, extensionType string, contents []byte) ([]byte, error) {
+	if sa, ok := a.(SessionAgent); ok {
+		return sa.ExtensionInSession(s, extensionType, contents)
+	}
+	if ea, ok := a.(agent.ExtendedAgent); ok {
+		return ea.Extension(extensionType, contents)
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
+
+type sessionAgent struct {
+	agent.Agent
+	session Session
+}
+
+// NewSessionAgent wraps a to serve a single connection, tracking the
+// connection's session
+func NewSessionAgent(a agent.Agent) agent.ExtendedAgent {
+	return &sessionAgent{Agent: a}
+}
+
+// NewRemoteSessionAgent is NewSessionAgent for a connection which comes
+// from another host, so is treated as forwarded from the start
+func NewRemoteSessionAgent(a agent.Agent) agent.ExtendedAgent {
+	return &sessionAgent{Agent: a, session: Session{forwarded: true}}
+}
+
+func (self *sessionAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return self.SignWithFlags(key, data, 0)
+}
+
+func (self *sessionAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return SignInSession(self.Agent, &self.session, key, data, flags)
+}
+
+func (self *sessionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == SessionBindExtension {
+		var req sessionBindRequest
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, errors.Wrap(err, "Parsing session-bind request")
+		}
+
+		self.session.mu.Lock()
+		// Once forwarded, a connection stays that way
+		self.session.forwarded = self.session.forwarded || req.IsForwarding
+		self.session.mu.Unlock()
+		return ExtensionResponse(nil), nil
+	}
+
+	return ExtensionInSession(self.Agent, &self.session, extensionType, contents)
+}
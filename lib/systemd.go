@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// ListenFds returns the listening sockets passed by systemd socket
+// activation (see sd_listen_fds(3)), keyed by their FileDescriptorName.
+// It returns nil if we weren't socket activated
+func ListenFds() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Using socket %s", name)
+		}
+
+		if _, ok := listeners[name]; ok {
+			name = name + "." + strconv.Itoa(fd)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+// SdNotify sends a state update to systemd (see sd_notify(3)), doing
+// nothing if we weren't started by systemd with NotifyAccess
+func SdNotify(state string) error {
+	// Go maps a leading @ to the abstract namespace, as systemd expects
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "Connecting to systemd")
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
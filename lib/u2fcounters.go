@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// U2FCountersFile returns the default file U2F signature counters are
+// stored in
+func U2FCountersFile() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "u2f-counters.json"), nil
+}
+
+// counterID identifies a credential in the counters file without
+// revealing its key handle
+func counterID(appID string, keyHandle []byte) string {
+	h := sha256.New()
+	h.Write([]byte(appID))
+	h.Write([]byte{0})
+	h.Write(keyHandle)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UpdateU2FCounter records the signature counter of a credential, failing
+// if it hasn't increased since the last time it was recorded. A counter
+// which goes backwards suggests the device has been cloned. Devices without
+// a counter always report 0, which is accepted
+func UpdateU2FCounter(file, appID string, keyHandle []byte, counter uint32) error {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Opening %s", file)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "Locking %s", file)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return errors.Wrapf(err, "Reading %s", file)
+	}
+
+	counters := make(map[string]uint32)
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &counters); err != nil {
+			return errors.Wrapf(err, "Parsing %s", file)
+		}
+	}
+
+	id := counterID(appID, keyHandle)
+	if last, ok := counters[id]; ok && counter <= last && (counter != 0 || last != 0) {
+		return errors.Errorf("Counter did not increase (%d after %d); the device may have been cloned",
+			counter, last)
+	}
+	counters[id] = counter
+
+	data, err = json.MarshalIndent(counters, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return errors.Wrapf(err, "Writing %s", file)
+	}
+	return f.Sync()
+}
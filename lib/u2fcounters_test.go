@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateU2FCounter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "u2f-counters.json")
+	kh := []byte{1, 2, 3}
+
+	for _, c := range []struct {
+		counter uint32
+		ok      bool
+	}{
+		{0, true},
+		// Devices without a counter
+		{0, true},
+		{5, true},
+		{5, false},
+		{4, false},
+		{0, false},
+		{6, true},
+	} {
+		err := UpdateU2FCounter(file, "pam://host", kh, c.counter)
+		if (err == nil) != c.ok {
+			t.Errorf("Counter %d: got %v", c.counter, err)
+		}
+	}
+
+	// Counters are per credential
+	if err := UpdateU2FCounter(file, "pam://other", kh, 1); err != nil {
+		t.Error(err)
+	}
+}
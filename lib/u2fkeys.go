@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Formats for U2F key mapping files
+const (
+	// U2FKeysEmissary is ssh-emissary's own format, with one
+	// "user:publickey,keyhandle" line per key in unpadded base64
+	U2FKeysEmissary = "emissary"
+	// U2FKeysPamU2F is the format of pam_u2f 1.1 and later, with one
+	// "user:keyhandle,publickey,es256,+presence[:...]" line per user
+	U2FKeysPamU2F = "pam_u2f"
+	// U2FKeysPamU2FLegacy is the format of pam_u2f before 1.1, with one
+	// "user:keyhandle,publickey[:...]" line per user. The key handle is
+	// web safe base64 and the public key hex
+	U2FKeysPamU2FLegacy = "pam_u2f-legacy"
+)
+
+// U2FCredential is a key registered with a U2F device
+type U2FCredential struct {
+	KeyHandle []byte
+	// PublicKey is an uncompressed P-256 point
+	PublicKey []byte
+}
+
+// FormatU2FCredential formats a credential as it appears after the user
+// name in a mapping file of the given format
+func FormatU2FCredential(format string, cred U2FCredential) (string, error) {
+	if len(cred.PublicKey) != 65 || cred.PublicKey[0] != 0x04 {
+		return "", errors.New("Public key is not an uncompressed P-256 point")
+	}
+
+	switch format {
+	case U2FKeysEmissary:
+		enc := base64.RawStdEncoding
+		return enc.EncodeToString(cred.PublicKey) + "," + enc.EncodeToString(cred.KeyHandle), nil
+	case U2FKeysPamU2F:
+		enc := base64.StdEncoding
+		return enc.EncodeToString(cred.KeyHandle) + "," +
+			enc.EncodeToString(cred.PublicKey[1:]) + ",es256,+presence", nil
+	case U2FKeysPamU2FLegacy:
+		return base64.RawURLEncoding.EncodeToString(cred.KeyHandle) + "," +
+			hex.EncodeToString(cred.PublicKey), nil
+	default:
+		return "", errors.Errorf("Unknown format %s", format)
+	}
+}
+
+// AppendU2FCredential adds a credential for user to a mapping file,
+// creating it if it doesn't exist. In the pam_u2f formats a user's
+// credentials share a line, so the credential is added to the user's line
+// if they have one
+func AppendU2FCredential(file, format, user string, cred U2FCredential) error {
+	formatted, err := FormatU2FCredential(format, cred)
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		if fi, err := os.Stat(file); err == nil {
+			mode = fi.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Reading %s", file)
+	}
+
+	var lines []string
+	if len(data) != 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	added := false
+	if format != U2FKeysEmissary {
+		for i, line := range lines {
+			if strings.HasPrefix(line, user+":") {
+				lines[i] = line + ":" + formatted
+				added = true
+				break
+			}
+		}
+	}
+	if !added {
+		lines = append(lines, user+":"+formatted)
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), mode); err != nil {
+		return errors.Wrapf(err, "Writing %s", tmp)
+	}
+	return os.Rename(tmp, file)
+}
+
+// decodeBase64 decodes base64 in any of the encodings mapping files use
+func decodeBase64(s string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	// Don't echo the input; the file may not be the user's to read
+	return nil, errors.New("Invalid base64")
+}
+
+// parseU2FCredential parses one credential in any of the formats
+func parseU2FCredential(s string) (cred U2FCredential, err error) {
+	fields := strings.Split(s, ",")
+	switch {
+	case len(fields) >= 3:
+		// pam_u2f: keyhandle,publickey,type,options
+		if fields[2] != "es256" {
+			return cred, errors.New("Unsupported key type")
+		}
+		if cred.KeyHandle, err = decodeBase64(fields[0]); err != nil {
+			return cred, err
+		}
+		pub, err := decodeBase64(fields[1])
+		if err != nil {
+			return cred, err
+		}
+		if len(pub) == 64 {
+			pub = append([]byte{0x04}, pub...)
+		}
+		cred.PublicKey = pub
+
+	case len(fields) == 2:
+		if pub, err := hex.DecodeString(fields[1]); err == nil && len(pub) == 65 {
+			// pam_u2f-legacy: keyhandle,publickey
+			cred.PublicKey = pub
+			cred.KeyHandle, err = decodeBase64(fields[0])
+			if err != nil {
+				return cred, err
+			}
+		} else {
+			// emissary: publickey,keyhandle
+			if cred.PublicKey, err = decodeBase64(fields[0]); err != nil {
+				return cred, err
+			}
+			if cred.KeyHandle, err = decodeBase64(fields[1]); err != nil {
+				return cred, err
+			}
+		}
+
+	default:
+		return cred, errors.New("Unable to find comma in credential")
+	}
+
+	if len(cred.PublicKey) != 65 || cred.PublicKey[0] != 0x04 {
+		return cred, errors.New("Public key is not an uncompressed P-256 point")
+	}
+	return cred, nil
+}
+
+// ParseU2FKeys parses a mapping file in any of the supported formats,
+// returning each user's credentials
+func ParseU2FKeys(data []byte) (map[string][]U2FCredential, error) {
+	users := make(map[string][]U2FCredential)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		if len(parts) < 2 {
+			return nil, errors.Errorf("Line %d: Unable to find user name", i+1)
+		}
+
+		user := parts[0]
+		for _, part := range parts[1:] {
+			cred, err := parseU2FCredential(part)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Line %d", i+1)
+			}
+			users[user] = append(users[user], cred)
+		}
+	}
+	return users, nil
+}
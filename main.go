@@ -17,6 +17,7 @@ package main
 import (
 	"github.com/erincandescent/ssh-emissary/cmd"
 	_ "github.com/erincandescent/ssh-emissary/pivagent"
+	_ "github.com/erincandescent/ssh-emissary/remoteagent"
 	_ "github.com/erincandescent/ssh-emissary/u2fagent"
 )
 
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus"
+)
+
+// fakeNotifications records calls to the freedesktop Notifications
+// interface
+type fakeNotifications struct {
+	summary, body string
+	hints         map[string]dbus.Variant
+	timeout       int32
+	closed        chan uint32
+}
+
+func (self *fakeNotifications) Notify(appName string, replacesID uint32, appIcon, summary, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	self.summary = summary
+	self.body = body
+	self.hints = hints
+	self.timeout = timeout
+	return 42, nil
+}
+
+func (self *fakeNotifications) CloseNotification(id uint32) *dbus.Error {
+	self.closed <- id
+	return nil
+}
+
+// privateBus starts a session bus of our own, returning its address
+func privateBus(t *testing.T) string {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is unavailable")
+	}
+
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Starting dbus-daemon: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Reading bus address: %s", err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+func connect(t *testing.T, addr string) *dbus.Conn {
+	conn, err := dbus.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.Auth(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Hello(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestDBusSink(t *testing.T) {
+	addr := privateBus(t)
+
+	server := connect(t, addr)
+	fake := &fakeNotifications{closed: make(chan uint32, 1)}
+	if err := server.Export(fake, notificationsPath, notificationsName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.RequestName(notificationsName, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewDBusSink(connect(t, addr))
+	dismiss, err := sink.Notify("Touch your token", "Signing with key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.summary != "Touch your token" || fake.body != "Signing with key" {
+		t.Errorf("Got notification %q %q", fake.summary, fake.body)
+	}
+	if v, ok := fake.hints["urgency"]; !ok || v.Value() != byte(2) {
+		t.Errorf("Got urgency %v, want critical", fake.hints["urgency"])
+	}
+	if fake.timeout <= 0 {
+		t.Errorf("Got expire_timeout %d, want a timeout", fake.timeout)
+	}
+
+	dismiss()
+	if id := <-fake.closed; id != 42 {
+		t.Errorf("Closed notification %d, want 42", id)
+	}
+}
@@ -0,0 +1,173 @@
+// Package notify tells the user when an operation is waiting for them,
+// e.g. to touch a token
+package notify
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// DefaultThreshold is how long an operation may wait before the user is notified
+const DefaultThreshold = 500 * time.Millisecond
+
+// Sink delivers notifications to the user
+type Sink interface {
+	// Notify shows a notification, returning a function which dismisses it
+	Notify(summary, body string) (dismiss func(), err error)
+}
+
+// Config is the notification configuration
+type Config struct {
+	// Threshold is a duration such as "500ms"
+	Threshold string       `json:"threshold"`
+	Sinks     []SinkConfig `json:"sinks"`
+}
+
+type SinkConfig struct {
+	Type   string          `json:"type"`
+	Params json.RawMessage `json:"params"`
+}
+
+type SinkFactory func(params json.RawMessage) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"dbus": dbusFactory,
+	"bell": bellFactory,
+	"hook": hookFactory,
+}
+
+var (
+	mu        sync.Mutex
+	sinks     []Sink
+	threshold = DefaultThreshold
+)
+
+// Configure sets up notifications from a JSON configuration
+func Configure(data json.RawMessage) error {
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+
+	t := DefaultThreshold
+	if config.Threshold != "" {
+		var err error
+		t, err = time.ParseDuration(config.Threshold)
+		if err != nil {
+			return errors.Wrap(err, "Parsing notification threshold")
+		}
+	}
+
+	var s []Sink
+	for _, v := range config.Sinks {
+		f, ok := sinkFactories[v.Type]
+		if !ok {
+			return errors.Errorf("Unknown notification sink %s", v.Type)
+		}
+
+		sink, err := f(v.Params)
+		if err != nil {
+			return errors.Wrapf(err, "Creating %s notification sink", v.Type)
+		}
+		s = append(s, sink)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	sinks = s
+	threshold = t
+	return nil
+}
+
+// Waiter notifies the user if an operation is still waiting once the
+// threshold has passed. Sinks may block, e.g. on D-Bus, so they are never
+// called with mu held
+type Waiter struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	done    bool
+	dismiss []func()
+}
+
+// Start starts waiting. The notification is shown if Done is not called
+// before the threshold passes
+func Start(summary, body string) *Waiter {
+	mu.Lock()
+	s := sinks
+	t := threshold
+	mu.Unlock()
+
+	w := &Waiter{}
+	if len(s) == 0 {
+		w.done = true
+		return w
+	}
+
+	w.timer = time.AfterFunc(t, func() {
+		w.mu.Lock()
+		done := w.done
+		w.mu.Unlock()
+		if done {
+			return
+		}
+
+		var dismisses []func()
+		var errs error
+		for _, sink := range s {
+			dismiss, err := sink.Notify(summary, body)
+			if err != nil {
+				errs = multierr.Append(errs, err)
+				continue
+			}
+			if dismiss != nil {
+				dismisses = append(dismisses, dismiss)
+			}
+		}
+
+		if errs != nil {
+			log.Printf("Error sending notification: %s", errs)
+		}
+
+		// If the operation finished while we were notifying, the
+		// notifications are dismissed at once
+		w.mu.Lock()
+		done = w.done
+		if !done {
+			w.dismiss = dismisses
+		}
+		w.mu.Unlock()
+		if done {
+			for _, dismiss := range dismisses {
+				dismiss()
+			}
+		}
+	})
+	return w
+}
+
+// Done marks the operation as finished, dismissing any notification in
+// the background
+func (w *Waiter) Done() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.done {
+		return
+	}
+
+	w.done = true
+	w.timer.Stop()
+	if len(w.dismiss) != 0 {
+		dismisses := w.dismiss
+		w.dismiss = nil
+		go func() {
+			for _, dismiss := range dismisses {
+				dismiss()
+			}
+		}()
+	}
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowSink takes a while to show notifications, like a busy notification
+// daemon
+type slowSink struct {
+	delay time.Duration
+
+	mu        sync.Mutex
+	shown     int
+	dismissed chan struct{}
+}
+
+func (s *slowSink) Notify(summary, body string) (func(), error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	s.shown++
+	s.mu.Unlock()
+	return func() { close(s.dismissed) }, nil
+}
+
+func configureSinks(t *testing.T, s Sink, th time.Duration) {
+	mu.Lock()
+	sinks, threshold = []Sink{s}, th
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		sinks, threshold = nil, DefaultThreshold
+		mu.Unlock()
+	})
+}
+
+func TestDoneWhileNotifying(t *testing.T) {
+	sink := &slowSink{delay: time.Second, dismissed: make(chan struct{})}
+	configureSinks(t, sink, 10*time.Millisecond)
+
+	w := Start("Touch your token", "Signing")
+	time.Sleep(50 * time.Millisecond)
+
+	// The sink is still showing the notification; Done mustn't wait for it
+	start := time.Now()
+	w.Done()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Done took %s", d)
+	}
+
+	// Once shown, the notification is dismissed
+	select {
+	case <-sink.dismissed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notification shown after Done wasn't dismissed")
+	}
+}
+
+func TestDoneDismisses(t *testing.T) {
+	sink := &slowSink{dismissed: make(chan struct{})}
+	configureSinks(t, sink, time.Millisecond)
+
+	w := Start("Touch your token", "Signing")
+	time.Sleep(50 * time.Millisecond)
+	w.Done()
+
+	select {
+	case <-sink.dismissed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notification wasn't dismissed")
+	}
+	if sink.shown != 1 {
+		t.Errorf("Notification shown %d times", sink.shown)
+	}
+}
+
+func TestDoneBeforeThreshold(t *testing.T) {
+	sink := &slowSink{dismissed: make(chan struct{})}
+	configureSinks(t, sink, 50*time.Millisecond)
+
+	Start("Touch your token", "Signing").Done()
+	time.Sleep(100 * time.Millisecond)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.shown != 0 {
+		t.Error("Notification shown after Done")
+	}
+}
@@ -0,0 +1,148 @@
+package notify
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+)
+
+// dbusSink shows desktop notifications through the freedesktop
+// Notifications interface on the session bus
+type dbusSink struct {
+	conn *dbus.Conn
+}
+
+const (
+	notificationsName = "org.freedesktop.Notifications"
+	notificationsPath = "/org/freedesktop/Notifications"
+)
+
+// NewDBusSink creates a sink which shows notifications using the
+// freedesktop Notifications service on the given bus
+func NewDBusSink(conn *dbus.Conn) Sink {
+	return &dbusSink{conn: conn}
+}
+
+func (self *dbusSink) Notify(summary, body string) (func(), error) {
+	obj := self.conn.Object(notificationsName, notificationsPath)
+
+	var id uint32
+	err := obj.Call(notificationsName+".Notify", 0,
+		"ssh-emissary",    // app_name
+		uint32(0),         // replaces_id
+		"dialog-password", // app_icon
+		summary,           // summary
+		body,              // body
+		[]string{},        // actions
+		map[string]dbus.Variant{ // hints
+			"urgency": dbus.MakeVariant(byte(2)),
+		},
+		int32(30000), // expire_timeout, in case the operation is abandoned
+	).Store(&id)
+	if err != nil {
+		return nil, errors.Wrap(err, "Sending desktop notification")
+	}
+
+	return func() {
+		call := obj.Call(notificationsName+".CloseNotification", 0, id)
+		if call.Err != nil {
+			log.Printf("Error closing desktop notification: %s", call.Err)
+		}
+	}, nil
+}
+
+func dbusFactory(params json.RawMessage) (Sink, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, errors.Wrap(err, "Connecting to session bus")
+	}
+	return NewDBusSink(conn), nil
+}
+
+// bellSink rings the terminal bell
+type bellSink struct {
+	tty string
+}
+
+type bellConfig struct {
+	// TTY is the terminal to ring. It is required, as the agent is usually
+	// detached from any terminal
+	TTY string `json:"tty"`
+}
+
+func (self *bellSink) Notify(summary, body string) (func(), error) {
+	f, err := os.OpenFile(self.tty, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Write([]byte("\a"))
+	return nil, err
+}
+
+func bellFactory(params json.RawMessage) (Sink, error) {
+	var config bellConfig
+	if len(params) != 0 {
+		if err := json.Unmarshal(params, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.TTY == "" {
+		return nil, errors.New("Bell notification has no tty")
+	}
+	return &bellSink{tty: config.TTY}, nil
+}
+
+// hookSink runs a command, passing the notification in the environment
+// variables SSH_EMISSARY_SUMMARY and SSH_EMISSARY_BODY
+type hookSink struct {
+	command []string
+}
+
+type hookConfig struct {
+	Command []string `json:"command"`
+}
+
+func (self *hookSink) Notify(summary, body string) (func(), error) {
+	cmd := exec.Command(self.command[0], self.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SSH_EMISSARY_SUMMARY="+summary,
+		"SSH_EMISSARY_BODY="+body)
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "Running notification hook")
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Notification hook failed: %s", err)
+		}
+	}()
+	return nil, nil
+}
+
+func hookFactory(params json.RawMessage) (Sink, error) {
+	var config hookConfig
+	if err := json.Unmarshal(params, &config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Command) == 0 {
+		return nil, errors.New("Notification hook has no command")
+	}
+
+	exe, err := tilde.Expand(config.Command[0])
+	if err != nil {
+		return nil, err
+	}
+	config.Command[0] = exe
+
+	return &hookSink{command: config.Command}, nil
+}
@@ -0,0 +1,185 @@
+package pivagent
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/erincandescent/cardkit/protocol"
+	"github.com/pkg/errors"
+	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+)
+
+// Yubico attestation certificate extensions
+var (
+	oidFirmwareVersion = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}
+	oidSerialNumber    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	oidPolicy          = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+)
+
+var pinPolicies = map[byte]string{
+	1: "never",
+	2: "once",
+	3: "always",
+}
+
+var touchPolicies = map[byte]string{
+	1: "never",
+	2: "always",
+	3: "cached",
+}
+
+// Attestation describes a key generated on a YubiKey, as reported by
+// its attestation certificate
+type Attestation struct {
+	Firmware    string
+	Serial      string
+	PINPolicy   string
+	TouchPolicy string
+
+	// Certificate is the attestation certificate for the slot
+	Certificate *x509.Certificate
+}
+
+// LoadAttestationRoots loads PEM encoded attestation root certificates,
+// such as the Yubico PIV attestation CA
+func LoadAttestationRoots(path string) ([]*x509.Certificate, error) {
+	path, err := tilde.Expand(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Reading %s", path)
+	}
+
+	var roots []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Parsing certificate in %s", path)
+		}
+		roots = append(roots, cert)
+	}
+
+	if len(roots) == 0 {
+		return nil, errors.Errorf("No certificates found in %s", path)
+	}
+	return roots, nil
+}
+
+// checkSignedBy checks that cert was signed by parent. The YubiKey's
+// attestation intermediate isn't always marked as a CA, so this checks
+// the signature directly rather than building a chain
+func checkSignedBy(cert, parent *x509.Certificate) error {
+	return parent.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
+
+// Attest fetches the attestation certificate for a slot and verifies it
+// against the card's attestation intermediate and the given roots. The
+// card must be locked with the PIV app selected
+func Attest(card *protocol.Card, id piv.KeyID, roots []*x509.Certificate) (*Attestation, error) {
+	der, err := piv.GetAttestation(card, id)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting attestation")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing attestation certificate")
+	}
+
+	intermediate, err := piv.GetCertificate(card, piv.AttestationKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting attestation intermediate")
+	}
+
+	x509intermediate, err := intermediate.ParseX509Certificate()
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing attestation intermediate")
+	}
+
+	if err := checkSignedBy(cert, x509intermediate); err != nil {
+		return nil, errors.Wrap(err, "Attestation not signed by card's intermediate")
+	}
+
+	verified := false
+	for _, root := range roots {
+		if checkSignedBy(x509intermediate, root) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("Attestation intermediate not signed by a trusted root")
+	}
+
+	return parseAttestation(cert)
+}
+
+func parseAttestation(cert *x509.Certificate) (*Attestation, error) {
+	a := &Attestation{Certificate: cert}
+
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidFirmwareVersion):
+			if len(ext.Value) != 3 {
+				return nil, errors.New("Invalid firmware version extension")
+			}
+			a.Firmware = fmt.Sprintf("%d.%d.%d", ext.Value[0], ext.Value[1], ext.Value[2])
+
+		case ext.Id.Equal(oidSerialNumber):
+			var serial int64
+			if _, err := asn1.Unmarshal(ext.Value, &serial); err != nil {
+				return nil, errors.Wrap(err, "Invalid serial number extension")
+			}
+			a.Serial = fmt.Sprint(serial)
+
+		case ext.Id.Equal(oidPolicy):
+			if len(ext.Value) != 2 {
+				return nil, errors.New("Invalid policy extension")
+			}
+			a.PINPolicy = pinPolicies[ext.Value[0]]
+			a.TouchPolicy = touchPolicies[ext.Value[1]]
+		}
+	}
+	return a, nil
+}
+
+// attestKey attests a listed key, checking that the attested key is the
+// one in the slot's certificate
+func (self *pivAgent) attestKey(c *pivCard, id piv.KeyID, x509cert *x509.Certificate) (*Attestation, error) {
+	a, err := Attest(c.card, id, self.attestationRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	slotKey, err := x509.MarshalPKIXPublicKey(x509cert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	attestedKey, err := x509.MarshalPKIXPublicKey(a.Certificate.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(slotKey, attestedKey) {
+		return nil, errors.New("Attested key does not match slot certificate")
+	}
+	return a, nil
+}
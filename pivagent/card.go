@@ -0,0 +1,90 @@
+package pivagent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/erincandescent/cardkit/protocol"
+	"github.com/pkg/errors"
+)
+
+// OpenCard opens a card using a transport string formatted as
+// "<name>" or "<name>:<params>"
+func OpenCard(transport string) (*protocol.Card, error) {
+	t, err := protocol.CreateTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return protocol.NewCard(t), nil
+}
+
+var slotNames = map[string]piv.KeyID{
+	"9a":                  piv.AuthenticationKey,
+	"authentication":      piv.AuthenticationKey,
+	"9c":                  piv.SignatureKey,
+	"signature":           piv.SignatureKey,
+	"9d":                  piv.KeyManagementKey,
+	"key-management":      piv.KeyManagementKey,
+	"9e":                  piv.CardAuthenticationKey,
+	"card-authentication": piv.CardAuthenticationKey,
+}
+
+// ParseSlot parses a slot given either by its hex ID (e.g. "9a")
+// or its name (e.g. "authentication")
+func ParseSlot(name string) (piv.KeyID, error) {
+	if id, ok := slotNames[strings.ToLower(name)]; ok {
+		return id, nil
+	}
+	return 0, errors.Errorf("Unknown slot %s", name)
+}
+
+var algorithmNames = map[string]piv.Algorithm{
+	"p256":    piv.AlgECCP256,
+	"p384":    piv.AlgECCP384,
+	"rsa2048": piv.AlgRSA2048,
+}
+
+// ParseAlgorithm parses a key algorithm name (p256, p384 or rsa2048)
+func ParseAlgorithm(name string) (piv.Algorithm, error) {
+	if alg, ok := algorithmNames[strings.ToLower(name)]; ok {
+		return alg, nil
+	}
+	return 0, errors.Errorf("Unknown algorithm %s", name)
+}
+
+// SelfSign creates a self-signed certificate for the key in the given slot.
+// The card must already be logged in if the slot requires it
+func SelfSign(card *protocol.Card, id piv.KeyID, pub crypto.PublicKey, subject string) ([]byte, error) {
+	alg, err := piv.AlgorithmFromPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: subject},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+
+	signer := piv.NewSigner(card, pub, id, alg)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "Signing certificate")
+	}
+	return der, nil
+}
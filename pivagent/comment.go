@@ -0,0 +1,87 @@
+package pivagent
+
+import (
+	"bytes"
+	"crypto/x509"
+	"text/template"
+	"time"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/pkg/errors"
+)
+
+// DefaultComment is the comment template used when none is configured
+const DefaultComment = `{{.Subject}}{{if .Serial}} #{{.Serial}}{{end}}`
+
+var slotIDs = map[piv.KeyID]string{
+	piv.AuthenticationKey:     "9a",
+	piv.SignatureKey:          "9c",
+	piv.KeyManagementKey:      "9d",
+	piv.CardAuthenticationKey: "9e",
+}
+
+// CommentFields are the fields available to comment templates
+type CommentFields struct {
+	// Label is the label given in the backend configuration
+	Label string
+	// Slot is the slot ID, e.g. "9a"
+	Slot string
+	// SlotName is the descriptive name of the slot
+	SlotName string
+	Serial   string
+	Reader   string
+	Subject  string
+	Issuer   string
+	// Expiry is the certificate's NotAfter time
+	Expiry time.Time
+
+	// Attested is true if the key was attested as generated on the card,
+	// in which case PINPolicy and TouchPolicy are also set
+	Attested    bool
+	PINPolicy   string
+	TouchPolicy string
+}
+
+var commentFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02")
+	},
+}
+
+// ParseComment parses a comment template
+func ParseComment(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultComment
+	}
+
+	tmpl, err := template.New("comment").Funcs(commentFuncs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing comment template")
+	}
+	return tmpl, nil
+}
+
+func (self *pivAgent) formatComment(c *pivCard, id piv.KeyID, cert *x509.Certificate, attestation *Attestation) string {
+	fields := CommentFields{
+		Label:    self.label,
+		Slot:     slotIDs[id],
+		SlotName: id.GetInfo().Name,
+		Serial:   c.serial,
+		Reader:   c.reader,
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		Expiry:   cert.NotAfter,
+	}
+
+	if attestation != nil {
+		fields.Attested = true
+		fields.PINPolicy = attestation.PINPolicy
+		fields.TouchPolicy = attestation.TouchPolicy
+	}
+
+	var buf bytes.Buffer
+	if err := self.comment.Execute(&buf, fields); err != nil {
+		return fields.Subject
+	}
+	return buf.String()
+}
@@ -0,0 +1,37 @@
+package pivagent
+
+import (
+	"fmt"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/erincandescent/cardkit/protocol"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+)
+
+// PinPrompt asks the user for card secrets using pinentry
+type PinPrompt struct {
+	lib.PinPrompt
+}
+
+// Login prompts for the application PIN and logs in to the card,
+// retrying while the card reports attempts remaining
+func (self *PinPrompt) Login(card *protocol.Card, desc string) error {
+	for {
+		pin, err := self.GetSecret(desc, "PIN:")
+		if err != nil {
+			return err
+		}
+
+		err = piv.Login(card, piv.ApplicationPIN, pin)
+		switch {
+		case protocol.PinAttempts(err) > 0:
+			self.Retry(fmt.Sprintf("%d attempts remaining", protocol.PinAttempts(err)))
+			continue
+		case err != nil:
+			return errors.Wrap(err, "Logging in")
+		default:
+			return nil
+		}
+	}
+}
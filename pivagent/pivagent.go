@@ -5,52 +5,115 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"text/template"
 
 	"github.com/erincandescent/cardkit/piv"
 	"github.com/erincandescent/cardkit/protocol"
 	"github.com/erincandescent/ssh-emissary/emissary"
-	"github.com/foxcpp/go-assuan/pinentry"
+	"github.com/erincandescent/ssh-emissary/notify"
 	"github.com/pkg/errors"
+	"go.uber.org/multierr"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
 
 type knownKey struct {
-	fp  []byte
-	id  piv.KeyID
-	pub crypto.PublicKey
+	fp   []byte
+	card *pivCard
+	id   piv.KeyID
+	pub  crypto.PublicKey
 }
 
+// pivAgent lists the keys of the cards in its readers. mu guards the
+// readers and keys, but isn't held while signing, which may wait for the
+// user; signatures are serialised by the card's own lock instead
 type pivAgent struct {
-	card      *protocol.Card
+	mu        sync.Mutex
+	readers   readerSet
 	knownKeys []knownKey
+
+	comment *template.Template
+	label   string
+
+	// attestationRoots, if set, are used to attest listed keys
+	attestationRoots   []*x509.Certificate
+	requireAttestation bool
+	attestations       map[string]*Attestation
 }
 
 var _ agent.Agent = &pivAgent{}
 
+var defaultComment = template.Must(ParseComment(DefaultComment))
+
+// NewAgent creates an agent backed by a single card
 func NewAgent(card *protocol.Card) agent.Agent {
-	agent := &pivAgent{card: card}
-	return agent
+	return newAgent(readerSet{
+		cards: map[string]*pivCard{"": {card: card}},
+	}, defaultComment, "")
+}
+
+func newAgent(readers readerSet, comment *template.Template, label string) *pivAgent {
+	return &pivAgent{
+		readers:      readers,
+		comment:      comment,
+		label:        label,
+		attestations: make(map[string]*Attestation),
+	}
 }
 
 func (self *pivAgent) List() (keys []*agent.Key, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
 	self.knownKeys = nil
-	if err := self.card.Lock(); err != nil {
-		return nil, errors.Wrap(err, "Error locking card")
+	if err := self.readers.refresh(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range self.readers.sorted() {
+		if c.signing == 0 {
+			kl, known, err := self.listCard(c)
+			if err != nil {
+				log.Printf("Error listing card in %s: %s", c.reader, err)
+				self.readers.forget(c)
+				continue
+			}
+			c.keys, c.known = kl, known
+		}
+		// else a signature is waiting on the card, perhaps for the user, so
+		// we list what it held last time
+
+		keys = append(keys, c.keys...)
+		self.knownKeys = append(self.knownKeys, c.known...)
+	}
+	return keys, nil
+}
+
+// ListedSlots are the slots whose keys are listed
+var ListedSlots = []piv.KeyID{piv.AuthenticationKey, piv.CardAuthenticationKey}
+
+func (self *pivAgent) listCard(c *pivCard) (keys []*agent.Key, known []knownKey, err error) {
+	if err := c.card.Lock(); err != nil {
+		return nil, nil, errors.Wrap(err, "Error locking card")
 	}
-	defer self.card.Unlock()
+	defer c.card.Unlock()
 
-	if err := piv.SelectApp(self.card); err != nil {
-		return nil, errors.Wrap(err, "Error selecting PIV app")
+	if err := piv.SelectApp(c.card); err != nil {
+		return nil, nil, errors.Wrap(err, "Error selecting PIV app")
 	}
 
-	keyIds := []piv.KeyID{piv.AuthenticationKey, piv.CardAuthenticationKey}
+	c.serial = readSerial(c.card)
+	if !self.readers.matchSerial(c.serial) {
+		return nil, nil, nil
+	}
 
-	for _, id := range keyIds {
-		cert, err := piv.GetCertificate(self.card, id)
+	for _, id := range ListedSlots {
+		cert, err := piv.GetCertificate(c.card, id)
 		if err != nil {
 			log.Printf("Error getting %s key: %s", id.GetInfo().Name, err)
 			continue
@@ -68,94 +131,141 @@ func (self *pivAgent) List() (keys []*agent.Key, err error) {
 			continue
 		}
 
-		self.knownKeys = append(self.knownKeys, knownKey{sshkey.Marshal(), id, x509cert.PublicKey})
+		var attestation *Attestation
+		if self.attestationRoots != nil {
+			attestation = self.attestations[string(sshkey.Marshal())]
+			if attestation == nil {
+				attestation, err = self.attestKey(c, id, x509cert)
+				if err != nil {
+					log.Printf("Error attesting %s key: %s", id.GetInfo().Name, err)
+				} else {
+					self.attestations[string(sshkey.Marshal())] = attestation
+				}
+			}
+		}
+
+		if self.requireAttestation && attestation == nil {
+			continue
+		}
+
+		known = append(known, knownKey{sshkey.Marshal(), c, id, x509cert.PublicKey})
 
 		keys = append(keys, &agent.Key{
 			Format:  sshkey.Type(),
 			Blob:    sshkey.Marshal(),
-			Comment: x509cert.Subject.String(),
+			Comment: self.formatComment(c, id, x509cert, attestation),
 		})
 	}
-	return keys, err
+	return keys, known, nil
+}
+
+// findKey looks up a listed key, marking its card as in use until done is
+// called
+func (self *pivAgent) findKey(fp []byte) (k knownKey, done func(), ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, k := range self.knownKeys {
+		if bytes.Equal(fp, k.fp) {
+			k.card.signing++
+			return k, func() {
+				self.mu.Lock()
+				k.card.signing--
+				self.mu.Unlock()
+			}, true
+		}
+	}
+	return knownKey{}, nil, false
 }
 
 func (self *pivAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	if err := self.card.Lock(); err != nil {
+	fp := key.Marshal()
+	k, done, ok := self.findKey(fp)
+	if !ok {
+		return nil, errors.New("Key not found")
+	}
+	sig, err := self.signWith(k, data)
+	done()
+
+	if _, gone := err.(*cardGoneError); !gone {
+		return sig, err
+	}
+
+	// The card may have been replugged; if its key is found again, we try
+	// once more
+	log.Printf("Error using card in %s, reopening it: %s", k.card.reader, err)
+	self.mu.Lock()
+	self.readers.forget(k.card)
+	self.mu.Unlock()
+	if _, err := self.List(); err != nil {
 		return nil, err
 	}
-	defer self.card.Unlock()
 
-	if err := piv.SelectApp(self.card); err != nil {
+	k, done, ok = self.findKey(fp)
+	if !ok {
 		return nil, err
 	}
+	defer done()
+	return self.signWith(k, data)
+}
 
-	fp := key.Marshal()
-	for _, k := range self.knownKeys {
-		if bytes.Equal(fp, k.fp) {
-			alg, err := piv.AlgorithmFromPublicKey(k.pub)
-			if err != nil {
+// cardGoneError is an error reaching a card, which may have been removed
+// or reset since it was opened
+type cardGoneError struct {
+	error
+}
+
+func (self *pivAgent) signWith(k knownKey, data []byte) (*ssh.Signature, error) {
+	card := k.card.card
+	if err := card.Lock(); err != nil {
+		return nil, &cardGoneError{errors.Wrap(err, "Error locking card")}
+	}
+	defer card.Unlock()
+
+	if err := piv.SelectApp(card); err != nil {
+		return nil, &cardGoneError{errors.Wrap(err, "Error selecting PIV app")}
+	}
+
+	alg, err := piv.AlgorithmFromPublicKey(k.pub)
+	if err != nil {
+		return nil, err
+	}
+
+	pivSigner := piv.NewSigner(card, k.pub, k.id, alg)
+	sshSigner, err := ssh.NewSignerFromSigner(pivSigner)
+	if err != nil {
+		return nil, err
+	}
+
+	var prompt PinPrompt
+	defer prompt.Close()
+
+	for {
+		// A key with touch policy "always" blocks here until touched
+		waiter := notify.Start("Touch your smartcard",
+			fmt.Sprintf("Waiting to sign with %s key", k.id.GetInfo().Name))
+		signature, err := sshSigner.Sign(rand.Reader, data)
+		waiter.Done()
+
+		switch {
+		case protocol.IsLoginRequired(err):
+			desc := fmt.Sprintf("Authenticating with %s key", k.id.GetInfo().Name)
+			if k.card.serial != "" {
+				desc = fmt.Sprintf("%s on card #%s", desc, k.card.serial)
+			}
+			if err := prompt.Login(card, desc); err != nil {
 				return nil, err
 			}
-
-			pivSigner := piv.NewSigner(self.card, k.pub, k.id, alg)
-			sshSigner, err := ssh.NewSignerFromSigner(pivSigner)
+		case err != nil:
+			return nil, errors.Wrap(err, "Signing")
+		default:
+			err := sshSigner.PublicKey().Verify(data, signature)
 			if err != nil {
 				return nil, err
 			}
-
-			var pinent *pinentry.Client
-			defer func() {
-				if pinent != nil {
-					pinent.Shutdown()
-				}
-			}()
-
-			for {
-				signature, err := sshSigner.Sign(rand.Reader, data)
-				switch {
-				case protocol.IsLoginRequired(err):
-					if pinent == nil {
-						pinent, err = pinentry.Launch()
-						if err != nil {
-							return nil, err
-						}
-					}
-
-					pinent.SetDesc(fmt.Sprintf("Authenticating with %s key", k.id.GetInfo().Name))
-					pinent.SetPrompt("PIN:")
-
-				pinLoop:
-					for {
-						pin, err := pinent.GetPIN()
-						if err != nil {
-							return nil, err
-						}
-
-						err = piv.Login(self.card, piv.ApplicationPIN, []byte(pin))
-						switch {
-						case protocol.PinAttempts(err) > 0:
-							pinent.SetRepeatPrompt(
-								fmt.Sprintf("%d attempts remaining", protocol.PinAttempts(err)))
-							continue
-						case err != nil:
-							return nil, errors.Wrap(err, "Logging in")
-						default:
-							break pinLoop
-						}
-					}
-				case err != nil:
-					return nil, errors.Wrap(err, "Signing")
-				default:
-					err := sshSigner.PublicKey().Verify(data, signature)
-					if err != nil {
-						return nil, err
-					}
-					return signature, nil
-				}
-			}
+			return signature, nil
 		}
 	}
-	return nil, errors.New("Key not found")
 }
 
 func (self *pivAgent) Add(key agent.AddedKey) error {
@@ -170,8 +280,27 @@ func (self *pivAgent) RemoveAll() error {
 	return errors.New("Cannot remove keys from smartcard")
 }
 
-func (self *pivAgent) Lock(passphrase []byte) error {
-	return piv.Logout(self.card)
+func (self *pivAgent) Lock(passphrase []byte) (errs error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, c := range self.readers.cards {
+		if err := piv.Logout(c.card); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Close logs out of every card, closes them and forgets them
+func (self *pivAgent) Close() error {
+	err := self.Lock(nil)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.knownKeys = nil
+	self.readers.closeAll()
+	return err
 }
 
 func (self *pivAgent) Unlock(passphrase []byte) error {
@@ -184,6 +313,15 @@ func (self *pivAgent) Signers() ([]ssh.Signer, error) {
 
 type pivConfig struct {
 	Transport string `json:"transport"`
+	Reader    string `json:"reader"`
+	Serial    string `json:"serial"`
+	Comment   string `json:"comment"`
+	Label     string `json:"label"`
+
+	// AttestationRoots is a PEM file of attestation roots. If set, keys
+	// are attested when listed
+	AttestationRoots   string `json:"attestation_roots"`
+	RequireAttestation bool   `json:"require_attestation"`
 }
 
 func pivFactory(params json.RawMessage) (agent.Agent, error) {
@@ -192,14 +330,40 @@ func pivFactory(params json.RawMessage) (agent.Agent, error) {
 		return nil, err
 	}
 
-	t, err := protocol.CreateTransport(config.Transport)
+	comment, err := ParseComment(config.Comment)
 	if err != nil {
 		return nil, err
 	}
 
-	c := protocol.NewCard(t)
+	// A transport with parameters names a specific card
+	readers := readerSet{cards: make(map[string]*pivCard)}
+	if _, reader := splitTransport(config.Transport); reader != "" {
+		c, err := OpenCard(config.Transport)
+		if err != nil {
+			return nil, err
+		}
+		readers.cards[""] = &pivCard{card: c, reader: reader}
+	} else {
+		readers.transport = config.Transport
+		readers.readerPattern = config.Reader
+		readers.serialPattern = config.Serial
+	}
+
+	a := newAgent(readers, comment, config.Label)
+
+	if config.RequireAttestation && config.AttestationRoots == "" {
+		return nil, errors.New("require_attestation needs attestation_roots")
+	}
+
+	if config.AttestationRoots != "" {
+		a.attestationRoots, err = LoadAttestationRoots(config.AttestationRoots)
+		if err != nil {
+			return nil, err
+		}
+		a.requireAttestation = config.RequireAttestation
+	}
 
-	return NewAgent(c), nil
+	return a, nil
 }
 
 func init() {
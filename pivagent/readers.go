@@ -0,0 +1,153 @@
+package pivagent
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/erincandescent/cardkit/piv"
+	"github.com/erincandescent/cardkit/protocol"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// pivCard is a card present in a reader
+type pivCard struct {
+	card   *protocol.Card
+	reader string
+	serial string
+
+	// keys and known are the card's keys when it was last listed
+	keys  []*agent.Key
+	known []knownKey
+	// signing counts the signatures using the card
+	signing int
+}
+
+func (c *pivCard) close() {
+	if err := c.card.Close(); err != nil {
+		log.Printf("Error closing card in %s: %s", c.reader, err)
+	}
+}
+
+// readerSet tracks the cards present in the readers of a transport,
+// following insertion and removal
+type readerSet struct {
+	// transport is the name of the transport readers are enumerated on.
+	// If empty, the set contains a single fixed card
+	transport string
+	// readerPattern and serialPattern select cards; empty matches all
+	readerPattern string
+	serialPattern string
+
+	cards map[string]*pivCard
+}
+
+// splitTransport splits a transport string into its name and parameters
+func splitTransport(transport string) (name, params string) {
+	if ix := strings.IndexByte(transport, ':'); ix != -1 {
+		return transport[:ix], transport[ix+1:]
+	}
+	return transport, ""
+}
+
+// readSerial reads the card serial, returning an empty string if the card
+// doesn't report one. The card must be locked with the PIV app selected
+func readSerial(card *protocol.Card) string {
+	serial, err := piv.GetSerial(card)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(serial)
+}
+
+func (self *readerSet) matchReader(reader string) bool {
+	if self.readerPattern == "" {
+		return true
+	}
+	ok, _ := path.Match(self.readerPattern, reader)
+	return ok
+}
+
+func (self *readerSet) matchSerial(serial string) bool {
+	if self.serialPattern == "" {
+		return true
+	}
+	ok, _ := path.Match(self.serialPattern, serial)
+	return ok
+}
+
+// refresh enumerates readers, opening cards in newly matching readers and
+// forgetting those which have been removed
+func (self *readerSet) refresh() error {
+	if self.transport == "" {
+		return nil
+	}
+
+	readers, err := protocol.ListReaders(self.transport)
+	if err != nil {
+		return errors.Wrap(err, "Error enumerating readers")
+	}
+
+	present := make(map[string]bool)
+	for _, reader := range readers {
+		if !self.matchReader(reader) {
+			continue
+		}
+		present[reader] = true
+
+		if _, ok := self.cards[reader]; ok {
+			continue
+		}
+
+		card, err := OpenCard(self.transport + ":" + reader)
+		if err != nil {
+			log.Printf("Error opening card in %s: %s", reader, err)
+			continue
+		}
+		self.cards[reader] = &pivCard{card: card, reader: reader}
+	}
+
+	for reader, c := range self.cards {
+		if !present[reader] {
+			c.close()
+			delete(self.cards, reader)
+		}
+	}
+	return nil
+}
+
+// sorted returns the cards ordered by reader name, so that keys are
+// listed in the same order each time
+func (self *readerSet) sorted() []*pivCard {
+	var readers []string
+	for reader := range self.cards {
+		readers = append(readers, reader)
+	}
+	sort.Strings(readers)
+
+	cards := make([]*pivCard, len(readers))
+	for i, reader := range readers {
+		cards[i] = self.cards[reader]
+	}
+	return cards
+}
+
+// forget drops a card after an error, so that it will be reopened on the
+// next refresh if it is still present. Fixed cards are never forgotten
+func (self *readerSet) forget(c *pivCard) {
+	if self.transport != "" && self.cards[c.reader] == c {
+		c.close()
+		delete(self.cards, c.reader)
+	}
+}
+
+// closeAll closes every card and forgets them
+func (self *readerSet) closeAll() {
+	for _, c := range self.cards {
+		c.close()
+	}
+	self.cards = make(map[string]*pivCard)
+}
@@ -0,0 +1,328 @@
+// Package remoteagent implements a backend which uses the agent of another
+// host over an SSH connection
+package remoteagent
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os/user"
+	"sort"
+
+	"github.com/erincandescent/ssh-emissary/emissary"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	tilde "gopkg.in/mattes/go-expand-tilde.v1"
+)
+
+// defaultCommand is run on the remote host if no socket is given
+const defaultCommand = "ssh-emissary serve --stdio"
+
+type remoteConfig struct {
+	// Host is the host, or host:port, to connect to
+	Host string `json:"host"`
+	// User defaults to the local user name
+	User string `json:"user"`
+	// Identity is a private key file to authenticate with
+	Identity string `json:"identity"`
+	// Agent is the socket of an agent to authenticate with
+	Agent string `json:"agent"`
+	// KnownHosts are the files the host key is checked against
+	KnownHosts []string `json:"known_hosts"`
+
+	// Socket is the path of the remote agent's socket, which is connected
+	// to by streamlocal forwarding
+	Socket string `json:"socket"`
+	// Command is run on the remote host to reach its agent over standard
+	// input and output, if Socket is not given
+	Command string `json:"command"`
+}
+
+// remoteAgent is a client of an agent on another host. It connects when
+// first used, and again after the connection is lost
+type remoteAgent struct {
+	*emissary.ReconnectingAgent
+
+	config       remoteConfig
+	addr         string
+	clientConfig *ssh.ClientConfig
+	identity     string
+
+	// signer and authAgent are only used while connecting, which happens
+	// once at a time
+	signer    ssh.Signer
+	authAgent agent.Agent
+}
+
+var _ agent.ExtendedAgent = &remoteAgent{}
+
+func remoteFactory(params json.RawMessage) (agent.Agent, error) {
+	var config remoteConfig
+	if err := json.Unmarshal(params, &config); err != nil {
+		return nil, err
+	}
+
+	if config.Host == "" {
+		return nil, errors.New("No host given")
+	}
+	if config.Command == "" {
+		config.Command = defaultCommand
+	}
+
+	addr := config.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	if config.User == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		config.User = u.Username
+	}
+
+	if len(config.KnownHosts) == 0 {
+		config.KnownHosts = []string{"~/.ssh/known_hosts"}
+	}
+	var knownHosts []string
+	for _, f := range config.KnownHosts {
+		f, err := tilde.Expand(f)
+		if err != nil {
+			return nil, err
+		}
+		knownHosts = append(knownHosts, f)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Loading known hosts")
+	}
+
+	self := &remoteAgent{config: config, addr: addr}
+	self.ReconnectingAgent = &emissary.ReconnectingAgent{
+		Name: "agent on " + config.Host,
+		Dial: self.connect,
+	}
+
+	var auth []ssh.AuthMethod
+	if config.Identity != "" {
+		if self.identity, err = tilde.Expand(config.Identity); err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeysCallback(self.identitySigners))
+	}
+	if config.Agent != "" {
+		auth = append(auth, ssh.PublicKeysCallback(self.agentSigners))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("No identity or agent to authenticate with")
+	}
+
+	self.clientConfig = &ssh.ClientConfig{
+		User:              config.User,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, addr),
+		Timeout:           emissary.DialTimeout,
+	}
+	return self, nil
+}
+
+// probeKey is a host key which is never known, so that checking it returns
+// the keys which are
+type probeKey struct{}
+
+func (probeKey) Type() string    { return "probe" }
+func (probeKey) Marshal() []byte { return nil }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("Probe key")
+}
+
+// knownHostKeyAlgorithms returns the algorithms of the keys known for addr,
+// so that the host offers one of those rather than a key we would refuse.
+// If no key is known, it returns nil, accepting the default algorithms
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero, Port: 22}, probeKey{})
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, k := range keyErr.Want {
+		if k.Key.Type() == ssh.KeyAlgoRSA {
+			// RSA keys are used with any of their signature algorithms
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, k.Key.Type())
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+// identitySigners loads the identity, asking for its passphrase the first
+// time if it is encrypted
+func (self *remoteAgent) identitySigners() ([]ssh.Signer, error) {
+	if self.signer != nil {
+		return []ssh.Signer{self.signer}, nil
+	}
+
+	pem, err := ioutil.ReadFile(self.identity)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		signer, err = self.decryptIdentity(pem)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Loading %s", self.identity)
+	}
+
+	self.signer = signer
+	return []ssh.Signer{signer}, nil
+}
+
+func (self *remoteAgent) decryptIdentity(pem []byte) (ssh.Signer, error) {
+	var prompt lib.PinPrompt
+	defer prompt.Close()
+
+	desc := "Enter the passphrase of " + self.identity + " to connect to " + self.config.Host
+	for {
+		passphrase, err := prompt.GetSecret(desc, "Passphrase:")
+		if err != nil {
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+		if err != x509.IncorrectPasswordError {
+			return signer, err
+		}
+		prompt.Retry("Incorrect passphrase")
+	}
+}
+
+// agentSigners returns the keys of the agent configured to authenticate
+// with, which is connected to for the duration of the handshake
+func (self *remoteAgent) agentSigners() ([]ssh.Signer, error) {
+	if self.authAgent == nil {
+		return nil, nil
+	}
+	return self.authAgent.Signers()
+}
+
+// connect connects to the remote host and its agent
+func (self *remoteAgent) connect() (io.ReadWriteCloser, error) {
+	if self.config.Agent != "" {
+		authAgent, conn, err := self.dialAuthAgent()
+		if err != nil {
+			return nil, err
+		}
+		self.authAgent = authAgent
+		defer func() {
+			conn.Close()
+			self.authAgent = nil
+		}()
+	}
+
+	client, err := ssh.Dial("tcp", self.addr, self.clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.config.Socket != "" {
+		ch, err := client.Dial("unix", self.config.Socket)
+		if err != nil {
+			client.Close()
+			return nil, errors.Wrapf(err, "Connecting to %s", self.config.Socket)
+		}
+		return &remoteConn{ch, client}, nil
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if err := session.Start(self.config.Command); err != nil {
+		client.Close()
+		return nil, errors.Wrapf(err, "Running %s", self.config.Command)
+	}
+
+	// Once the command exits, the connection is of no further use
+	go func() {
+		if err := session.Wait(); err != nil {
+			log.Printf("%s on %s exited: %s", self.config.Command, self.config.Host, err)
+		}
+		client.Close()
+	}()
+	return &remoteConn{
+		struct {
+			io.Reader
+			io.Writer
+		}{stdout, stdin},
+		client,
+	}, nil
+}
+
+// dialAuthAgent connects to the agent configured to authenticate with,
+// refusing it if it leads back to us: we would be asked for the keys we
+// are connecting to list
+func (self *remoteAgent) dialAuthAgent() (agent.Agent, net.Conn, error) {
+	sock, err := tilde.Expand(self.config.Agent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.DialTimeout("unix", sock, emissary.DialTimeout)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Connecting to agent to authenticate with")
+	}
+	a := agent.NewClient(conn)
+
+	loop, err := emissary.CheckLoop(a, []string{emissary.InstanceID})
+	if err != nil && err != agent.ErrExtensionUnsupported {
+		conn.Close()
+		return nil, nil, errors.Wrap(err, "Checking agent to authenticate with for loops")
+	}
+	if loop {
+		conn.Close()
+		return nil, nil, errors.Errorf("Refusing to authenticate with %s, which leads back to this agent", sock)
+	}
+	return a, conn, nil
+}
+
+// remoteConn is the connection to the remote agent, which closes the SSH
+// connection it is made over when closed
+type remoteConn struct {
+	io.ReadWriter
+	client *ssh.Client
+}
+
+func (self *remoteConn) Close() error {
+	return self.client.Close()
+}
+
+func init() {
+	emissary.RegisterBackend("ssh-remote", remoteFactory)
+}
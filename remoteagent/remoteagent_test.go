@@ -0,0 +1,57 @@
+package remoteagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostKeyAlgorithms(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines string
+	for _, k := range []interface{}{edKey.Public(), &rsaKey.PublicKey} {
+		pub, err := ssh.NewPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += knownhosts.Line([]string{"bastion.example.com:2222"}, pub) + "\n"
+	}
+
+	f, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(lines)
+	f.Close()
+
+	callback, err := knownhosts.New(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := knownHostKeyAlgorithms(callback, "bastion.example.com:2222")
+	want := []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got algorithms %v, want %v", got, want)
+	}
+
+	if got := knownHostKeyAlgorithms(callback, "other.example.com:22"); got != nil {
+		t.Errorf("Got algorithms %v for an unknown host, want none", got)
+	}
+}
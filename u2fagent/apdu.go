@@ -0,0 +1,123 @@
+package u2fagent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+// U2F raw message instructions
+const (
+	insRegister     = 0x01
+	insAuthenticate = 0x02
+	insVersion      = 0x03
+)
+
+// appIDSet is a set of permitted application parameters
+type appIDSet map[[32]byte]bool
+
+// newAppIDSet builds a set from AppIDs, which may be given as the AppID
+// string or as its hex encoded SHA-256 hash
+func newAppIDSet(appIDs []string) appIDSet {
+	set := make(appIDSet)
+	for _, id := range appIDs {
+		var hash [32]byte
+		if b, err := hex.DecodeString(id); err == nil && len(b) == 32 {
+			copy(hash[:], b)
+		} else {
+			hash = sha256.Sum256([]byte(id))
+		}
+		set[hash] = true
+	}
+	return set
+}
+
+// parseAPDU splits a U2F request APDU into its instruction and data,
+// accepting both short and extended length encodings. Anything but an
+// expected length after the data is refused, so that the device can't read
+// the request differently from us
+func parseAPDU(apdu []byte) (ins byte, data []byte, err error) {
+	if len(apdu) < 4 {
+		return 0, nil, errors.New("Short APDU")
+	}
+	ins = apdu[1]
+	body := apdu[4:]
+
+	switch {
+	case len(body) <= 1:
+		// No data, with an optional short Le
+		return ins, nil, nil
+	case body[0] == 0 && len(body) == 3:
+		// No data, with an extended Le: 00 Le1 Le2
+		return ins, nil, nil
+	case body[0] == 0:
+		// Extended: 00 Lc1 Lc2 data [Le1 Le2]
+		if len(body) < 3 {
+			return 0, nil, errors.New("Truncated APDU")
+		}
+		lc := int(body[1])<<8 | int(body[2])
+		if lc == 0 && len(body) == 5 {
+			// A zero Lc, then Le, which clients send for requests
+			// without data
+			return ins, nil, nil
+		}
+		rest := len(body) - 3 - lc
+		if lc == 0 || rest < 0 {
+			return 0, nil, errors.New("Truncated APDU")
+		}
+		if rest != 0 && rest != 2 {
+			return 0, nil, errors.New("Malformed APDU length")
+		}
+		return ins, body[3 : 3+lc], nil
+	default:
+		// Short: Lc data [Le]
+		lc := int(body[0])
+		rest := len(body) - 1 - lc
+		if rest < 0 {
+			return 0, nil, errors.New("Truncated APDU")
+		}
+		if rest > 1 {
+			return 0, nil, errors.New("Malformed APDU length")
+		}
+		return ins, body[1 : 1+lc], nil
+	}
+}
+
+// checkAPDU verifies that a request is one we are willing to pass to a
+// device: a register, authenticate or version request, for an AppID the
+// client is permitted to use
+func (self *u2fAgent) checkAPDU(apdu []byte, forwarded bool) error {
+	ins, data, err := parseAPDU(apdu)
+	if err != nil {
+		return err
+	}
+
+	switch ins {
+	case insVersion:
+		return nil
+	case insRegister, insAuthenticate:
+		// challenge parameter (32) | application parameter (32) | ...
+		if len(data) < 64 {
+			return errors.New("Short U2F request")
+		}
+	default:
+		return errors.Errorf("U2F instruction %02x not permitted", ins)
+	}
+
+	var app [32]byte
+	copy(app[:], data[32:64])
+	return self.checkAppID(app, forwarded)
+}
+
+// checkAppID verifies that the client may use the application parameter app
+func (self *u2fAgent) checkAppID(app [32]byte, forwarded bool) error {
+	if forwarded {
+		if !self.remoteAppIDs[app] {
+			return errors.Errorf("AppID %x not permitted for forwarded connections", app)
+		}
+	} else if self.appIDs != nil && !self.appIDs[app] {
+		return errors.Errorf("AppID %x not permitted", app)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package u2fagent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// shortAPDU encodes a request with a short length
+func shortAPDU(ins byte, data []byte, le ...byte) []byte {
+	apdu := append([]byte{0, ins, 0, 0, byte(len(data))}, data...)
+	return append(apdu, le...)
+}
+
+// extendedAPDU encodes a request with an extended length
+func extendedAPDU(ins byte, data []byte, le ...byte) []byte {
+	apdu := append([]byte{0, ins, 0, 0, 0, byte(len(data) >> 8), byte(len(data))}, data...)
+	return append(apdu, le...)
+}
+
+// u2fRequest is a register or authenticate request body for app
+func u2fRequest(app string, extra int) []byte {
+	challenge := sha256.Sum256([]byte("challenge"))
+	appParam := sha256.Sum256([]byte(app))
+	data := append(challenge[:], appParam[:]...)
+	return append(data, bytes.Repeat([]byte{0x55}, extra)...)
+}
+
+func TestParseAPDU(t *testing.T) {
+	data := u2fRequest("https://example.com", 0)
+
+	tests := []struct {
+		name string
+		apdu []byte
+		ins  byte
+		data []byte
+		ok   bool
+	}{
+		{"short", shortAPDU(insRegister, data), insRegister, data, true},
+		{"short with Le", shortAPDU(insRegister, data, 0), insRegister, data, true},
+		{"extended", extendedAPDU(insAuthenticate, data), insAuthenticate, data, true},
+		{"extended with Le", extendedAPDU(insAuthenticate, data, 0, 0), insAuthenticate, data, true},
+		{"no data", []byte{0, insVersion, 0, 0}, insVersion, nil, true},
+		{"no data, short Le", []byte{0, insVersion, 0, 0, 0}, insVersion, nil, true},
+		{"no data, extended Le", []byte{0, insVersion, 0, 0, 0, 0, 0}, insVersion, nil, true},
+		{"no data, zero Lc and Le", []byte{0, insVersion, 0, 0, 0, 0, 0, 0, 0}, insVersion, nil, true},
+
+		{"header only", []byte{0, insVersion, 0}, 0, nil, false},
+		{"short truncated", shortAPDU(insRegister, data)[:40], 0, nil, false},
+		{"short Lc oversized", append([]byte{0, insRegister, 0, 0, 0xff}, data...), 0, nil, false},
+		{"short trailing data", shortAPDU(insRegister, data, 0, 0), 0, nil, false},
+		{"extended truncated", extendedAPDU(insRegister, data)[:40], 0, nil, false},
+		{"extended Lc oversized", append([]byte{0, insRegister, 0, 0, 0, 0x10, 0}, data...), 0, nil, false},
+		{"extended Lc zero", append([]byte{0, insRegister, 0, 0, 0, 0, 0}, data...), 0, nil, false},
+		{"extended odd trailing data", extendedAPDU(insRegister, data, 0), 0, nil, false},
+		{"extended trailing data", extendedAPDU(insRegister, data, 0, 0, 0), 0, nil, false},
+		{"extended length cut off", []byte{0, insRegister, 0, 0, 0, 1}, 0, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ins, data, err := parseAPDU(tt.apdu)
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("Parsed as instruction %02x with %d bytes of data", ins, len(data))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ins != tt.ins || !bytes.Equal(data, tt.data) {
+				t.Errorf("Parsed as instruction %02x with %x, want %02x with %x", ins, data, tt.ins, tt.data)
+			}
+		})
+	}
+}
+
+func TestCheckAPDU(t *testing.T) {
+	a := &u2fAgent{
+		appIDs:       newAppIDSet([]string{"https://local.example.com", "https://both.example.com"}),
+		remoteAppIDs: newAppIDSet([]string{"https://both.example.com"}),
+	}
+	open := &u2fAgent{remoteAppIDs: newAppIDSet(nil)}
+
+	local := u2fRequest("https://local.example.com", 65)
+	both := u2fRequest("https://both.example.com", 65)
+	other := u2fRequest("https://other.example.com", 65)
+
+	tests := []struct {
+		name      string
+		agent     *u2fAgent
+		apdu      []byte
+		local     bool
+		forwarded bool
+	}{
+		{"version", a, []byte{0, insVersion, 0, 0}, true, true},
+		{"register local AppID", a, shortAPDU(insRegister, local[:64]), true, false},
+		{"authenticate local AppID", a, extendedAPDU(insAuthenticate, local, 0, 0), true, false},
+		{"authenticate remote AppID", a, extendedAPDU(insAuthenticate, both, 0, 0), true, true},
+		{"register remote AppID", a, shortAPDU(insRegister, both[:64], 0), true, true},
+		{"authenticate other AppID", a, extendedAPDU(insAuthenticate, other), false, false},
+		{"any AppID without appids", open, extendedAPDU(insAuthenticate, other), true, false},
+		{"short request", a, shortAPDU(insAuthenticate, local[:63]), false, false},
+		{"truncated request", a, extendedAPDU(insAuthenticate, both)[:60], false, false},
+		{"oversized Lc", a, append([]byte{0, insAuthenticate, 0, 0, 0, 0x01, 0}, both...), false, false},
+		{"trailing data", a, append(extendedAPDU(insAuthenticate, both, 0, 0), 0), false, false},
+		{"vendor instruction", a, extendedAPDU(0x40, both), false, false},
+		{"reset instruction", a, []byte{0, 0xc0, 0, 0}, false, false},
+		{"no instruction", a, []byte{0, 0, 0, 0}, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.agent.checkAPDU(tt.apdu, false); (err == nil) != tt.local {
+				t.Errorf("Local: got %v, want allowed %v", err, tt.local)
+			}
+			if err := tt.agent.checkAPDU(tt.apdu, true); (err == nil) != tt.forwarded {
+				t.Errorf("Forwarded: got %v, want allowed %v", err, tt.forwarded)
+			}
+		})
+	}
+}
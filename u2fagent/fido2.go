@@ -0,0 +1,434 @@
+package u2fagent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/notify"
+	"github.com/flynn/u2f/u2fhid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// pinPrompt asks the user for a device PIN
+type pinPrompt interface {
+	GetSecret(desc, prompt string) ([]byte, error)
+	Retry(msg string)
+	Close()
+}
+
+// How we find devices and ask for PINs; replaced by the tests
+var (
+	enumerateDevices = u2fhid.Devices
+	openHID          = ctap2.OpenHID
+	newPINPrompt     = func() pinPrompt { return &lib.PinPrompt{} }
+)
+
+// fido2Device is a pooled CTAP2 capable device
+type fido2Device struct {
+	dev    *pooledDevice
+	client *ctap2.Client
+	info   *ctap2.Info
+
+	// onPresenceNeeded, if set, is called when the device waits for the
+	// user to touch it
+	onPresenceNeeded func()
+}
+
+// CBOR implements ctap2.Transport
+func (d *fido2Device) CBOR(data []byte) ([]byte, error) {
+	return d.dev.CBOR(data, d.onPresenceNeeded)
+}
+
+func (d *fido2Device) product() string {
+	return d.dev.info.Product
+}
+
+// openFIDO2Devices opens every connected device which speaks CTAP2. They
+// come from the pool, so their requests are serialised with U2F requests
+func (self *u2fAgent) openFIDO2Devices() ([]*fido2Device, error) {
+	infos, err := self.devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []*fido2Device
+	for _, info := range infos {
+		dev, err := self.pool.get(info)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		if cbor, err := dev.supportsCBOR(); err != nil {
+			log.Printf("Error opening %s: %s", info.Product, err)
+			continue
+		} else if !cbor {
+			continue
+		}
+
+		d := &fido2Device{dev: dev}
+		d.client = ctap2.NewClient(d)
+		d.info, err = d.client.GetInfo()
+		if err != nil {
+			log.Printf("Error getting info from %s: %s", info.Product, err)
+			continue
+		}
+
+		devices = append(devices, d)
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New("No FIDO2 devices found")
+	}
+	return devices, nil
+}
+
+// withPIN runs fn, prompting for the device PIN and retrying with a PIN
+// token if the device requires one
+func (d *fido2Device) withPIN(desc string, fn func(token []byte) error) error {
+	err := fn(nil)
+	if err != ctap2.StatusPINRequired && err != ctap2.StatusOperationDenied {
+		return err
+	}
+
+	token, err := d.pinToken(desc)
+	if err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+func (d *fido2Device) pinToken(desc string) ([]byte, error) {
+	prompt := newPINPrompt()
+	defer prompt.Close()
+
+	for {
+		pin, err := prompt.GetSecret(desc, "PIN:")
+		if err != nil {
+			return nil, err
+		}
+
+		token, err := d.client.GetPINToken(string(pin))
+		switch err {
+		case nil:
+			return token, nil
+		case ctap2.StatusPINInvalid:
+			retries, _ := d.client.PINRetries()
+			prompt.Retry(fmt.Sprintf("%d attempts remaining", retries))
+		case ctap2.StatusPINAuthInvalid:
+			// Too many failures; the device must be replugged
+			return nil, errors.New("PIN temporarily blocked; reinsert the device")
+		default:
+			return nil, errors.Wrap(err, "Getting PIN token")
+		}
+	}
+}
+
+// selectFIDO2Device asks the user to touch one of several devices,
+// cancelling the requests to the others once they have
+func selectFIDO2Device(devices []*fido2Device) (*fido2Device, error) {
+	if len(devices) == 1 {
+		return devices[0], nil
+	}
+
+	type result struct {
+		d   *fido2Device
+		err error
+	}
+	results := make(chan result, len(devices))
+	for _, d := range devices {
+		go func(d *fido2Device) {
+			results <- result{d, d.client.Select()}
+		}(d)
+	}
+
+	var selected *fido2Device
+	var err error
+	for range devices {
+		r := <-results
+		switch {
+		case r.err == nil && selected == nil:
+			selected = r.d
+			for _, d := range devices {
+				if d != selected {
+					d.dev.Cancel()
+				}
+			}
+		case r.err != nil && r.err != ctap2.StatusKeepaliveCancel:
+			log.Printf("Error selecting %s: %s", r.d.product(), r.err)
+			err = r.err
+		}
+	}
+
+	if selected == nil {
+		return nil, errors.Wrap(err, "Selecting device")
+	}
+	return selected, nil
+}
+
+// fido2Register creates a new credential on whichever device the user
+// touches. If there are several the user touches one to select it first,
+// as CTAP2 authenticators wait for the touch themselves
+func (self *u2fAgent) fido2Register(s *lib.Session, req SKRegisterRequest) (*skKey, error) {
+	app := sha256.Sum256([]byte(req.Application))
+	if err := self.checkAppID(app, s.Forwarded()); err != nil {
+		return nil, err
+	}
+
+	alg := ctap2.AlgES256
+	if req.Algorithm == "ed25519" {
+		alg = ctap2.AlgEdDSA
+	}
+
+	devices, err := self.openFIDO2Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return nil, err
+	}
+
+	userID := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, userID); err != nil {
+		return nil, err
+	}
+
+	waiter := notify.Start("Touch your security key", "Registering a new SSH key")
+	defer waiter.Done()
+
+	d, err := selectFIDO2Device(devices)
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *ctap2.Credential
+	err = d.withPIN("Registering a new SSH key", func(token []byte) error {
+		var err error
+		cred, err = d.client.MakeCredential(ctap2.MakeCredentialOptions{
+			RP:             ctap2.RelyingParty{ID: req.Application},
+			User:           ctap2.User{ID: userID, Name: req.Comment},
+			ClientDataHash: challenge,
+			Algorithm:      alg,
+			Resident:       req.Resident,
+			PINToken:       token,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating credential")
+	}
+
+	k, err := fido2Key(req.Application, cred.ID, cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	k.Comment = req.Comment
+	if k.Comment == "" {
+		k.Comment = self.comment(d.dev.info)
+	}
+	return k, nil
+}
+
+// fido2Key creates a key from a CTAP2 credential
+func fido2Key(application string, id []byte, cose *ctap2.COSEKey) (*skKey, error) {
+	pub, err := cose.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	k := &skKey{
+		Application: application,
+		KeyHandle:   id,
+		CTAP2:       true,
+	}
+
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		k.PublicKey = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	case ed25519.PublicKey:
+		k.Algorithm = "ed25519"
+		k.PublicKey = pub
+	default:
+		return nil, errors.New("Unsupported credential key type")
+	}
+	return k, nil
+}
+
+// fido2Sign produces an OpenSSH security key signature using CTAP2
+func (self *u2fAgent) fido2Sign(k *skKey, data []byte) (*ssh.Signature, error) {
+	devices, err := self.openFIDO2Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := sha256.Sum256(data)
+	opts := ctap2.GetAssertionOptions{
+		RPID:           k.Application,
+		ClientDataHash: challenge[:],
+		CredentialIDs:  [][]byte{k.KeyHandle},
+	}
+
+	// Find the device holding the credential without bothering the user
+	var dev *fido2Device
+	for _, d := range devices {
+		silent := opts
+		silent.Silent = true
+		_, err := d.client.GetAssertion(silent)
+		if err == nil || err == ctap2.StatusPINRequired || err == ctap2.StatusOperationDenied {
+			dev = d
+			break
+		} else if err != ctap2.StatusNoCredentials {
+			log.Printf("Error checking %s: %s", d.product(), err)
+		}
+	}
+	if dev == nil {
+		return nil, errors.New("Device not found")
+	}
+
+	var waiter *notify.Waiter
+	dev.onPresenceNeeded = func() {
+		if waiter == nil {
+			waiter = notify.Start("Touch your security key", k.Comment+" is waiting for you")
+		}
+	}
+	defer func() {
+		if waiter != nil {
+			waiter.Done()
+		}
+	}()
+
+	var assertion *ctap2.Assertion
+	err = dev.withPIN("Authenticating with "+k.Comment, func(token []byte) error {
+		var err error
+		o := opts
+		o.PINToken = token
+		assertion, err = dev.client.GetAssertion(o)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting assertion")
+	}
+
+	ad, err := ctap2.ParseAuthData(assertion.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &ssh.Signature{
+		Format: k.sshType(),
+		// The signature is followed by the flags and counter
+		Rest: append([]byte(nil), assertion.AuthData[32:37]...),
+	}
+
+	if k.Algorithm == "ed25519" {
+		sig.Blob = assertion.Signature
+	} else {
+		var ecSig struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(assertion.Signature, &ecSig); err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling signature")
+		}
+		sig.Blob = ssh.Marshal(&ecSig)
+	}
+
+	log.Printf("Signed with %s, counter %d", k.Comment, ad.Counter)
+	return sig, nil
+}
+
+// loadResidentKeys enumerates SSH credentials resident on each device
+// not already seen, prompting for the device PIN. It runs in the
+// background, so a slow user doesn't hold up List
+func (self *u2fAgent) loadResidentKeys() {
+	defer func() {
+		self.mu.Lock()
+		self.residentLoading = false
+		self.mu.Unlock()
+	}()
+
+	devices, err := self.openFIDO2Devices()
+	if err != nil {
+		return
+	}
+
+	present := make(map[string]bool)
+	for _, d := range devices {
+		path := d.dev.info.Path
+		present[path] = true
+
+		// Don't retry devices which fail, until they are replugged
+		self.mu.Lock()
+		_, seen := self.resident[path]
+		if !seen {
+			self.resident[path] = nil
+		}
+		self.mu.Unlock()
+		if seen {
+			continue
+		}
+
+		keys, err := self.residentKeys(d)
+		if err != nil {
+			log.Printf("Error listing resident keys on %s: %s", d.product(), err)
+			continue
+		}
+
+		self.mu.Lock()
+		self.resident[path] = keys
+		self.mu.Unlock()
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for path := range self.resident {
+		if !present[path] {
+			delete(self.resident, path)
+		}
+	}
+}
+
+// residentKeys lists the SSH credentials resident on a device
+func (self *u2fAgent) residentKeys(d *fido2Device) ([]*skKey, error) {
+	token, err := d.pinToken("Listing SSH keys on " + d.product())
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting PIN token")
+	}
+
+	creds, err := d.client.ResidentCredentials(d.info, token, func(rpID string) bool {
+		return strings.HasPrefix(rpID, "ssh:")
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Enumerating credentials")
+	}
+
+	var keys []*skKey
+	for _, c := range creds {
+		k, err := fido2Key(c.RPID, c.ID, c.PublicKey)
+		if err != nil {
+			log.Printf("Error loading resident key: %s", err)
+			continue
+		}
+
+		k.Comment = c.User.Name
+		if k.Comment == "" {
+			k.Comment = self.comment(d.dev.info)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
@@ -0,0 +1,251 @@
+package u2fagent
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/erincandescent/ssh-emissary/ctap2/ctap2test"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/flynn/hid"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// fixedPrompt answers every PIN prompt with the same PIN
+type fixedPrompt struct {
+	pin     string
+	prompts *int
+}
+
+func (p fixedPrompt) GetSecret(desc, prompt string) ([]byte, error) {
+	*p.prompts++
+	return []byte(p.pin), nil
+}
+
+func (p fixedPrompt) Retry(msg string) {}
+func (p fixedPrompt) Close()           {}
+
+// fakeDevices attaches software authenticators in place of the real
+// devices, returning how many PIN prompts have been shown
+func fakeDevices(t *testing.T, pin string, auths ...*ctap2test.Authenticator) *int {
+	var infos []*hid.DeviceInfo
+	byPath := make(map[string]*ctap2test.Authenticator)
+	for i, a := range auths {
+		info := &hid.DeviceInfo{
+			Path:         string(rune('a' + i)),
+			Product:      "Fake FIDO2",
+			SerialNumber: string(rune('a' + i)),
+		}
+		infos = append(infos, info)
+		byPath[info.Path] = a
+	}
+
+	prompts := new(int)
+	oldEnumerate, oldOpen, oldPrompt := enumerateDevices, openHID, newPINPrompt
+	enumerateDevices = func() ([]*hid.DeviceInfo, error) { return infos, nil }
+	openHID = func(info *hid.DeviceInfo) (*ctap2.HIDDevice, error) {
+		return ctap2.NewHIDDevice(info, byPath[info.Path])
+	}
+	newPINPrompt = func() pinPrompt { return fixedPrompt{pin, prompts} }
+	t.Cleanup(func() {
+		enumerateDevices, openHID, newPINPrompt = oldEnumerate, oldOpen, oldPrompt
+	})
+	return prompts
+}
+
+func newTestAgent(t *testing.T, resident bool) *u2fAgent {
+	params, _ := json.Marshal(u2fConfig{
+		SKKeys:       filepath.Join(t.TempDir(), "sk-keys.json"),
+		ResidentKeys: resident,
+	})
+	a, err := u2fFactory(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*u2fAgent)
+}
+
+// skKeys returns the security keys listed by the agent
+func skKeys(t *testing.T, a *u2fAgent) []*agent.Key {
+	t.Helper()
+
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sk []*agent.Key
+	for _, k := range keys {
+		if k.Format != "u2f" {
+			sk = append(sk, k)
+		}
+	}
+	return sk
+}
+
+func register(t *testing.T, a *u2fAgent, req SKRegisterRequest) ssh.PublicKey {
+	t.Helper()
+
+	res, err := a.ExtensionInSession(nil, SKRegisterExtension, ssh.Marshal(&req))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp SKRegisterResponse
+	if err := ssh.Unmarshal(res[1:], &resp); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.ParsePublicKey(resp.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestFIDO2RegisterAndSign(t *testing.T) {
+	for _, alg := range []string{"ecdsa", "ed25519"} {
+		t.Run(alg, func(t *testing.T) {
+			auth := ctap2test.New("1234")
+			prompts := fakeDevices(t, "1234", auth)
+			a := newTestAgent(t, false)
+
+			pub := register(t, a, SKRegisterRequest{
+				Application: "ssh:",
+				Comment:     "test key",
+				Algorithm:   alg,
+				Resident:    true,
+			})
+			if *prompts != 1 {
+				t.Errorf("Prompted for the PIN %d times", *prompts)
+			}
+
+			keys := skKeys(t, a)
+			if len(keys) != 1 || string(keys[0].Blob) != string(pub.Marshal()) || keys[0].Comment != "test key" {
+				t.Fatalf("Listed %v", keys)
+			}
+
+			data := []byte("session data")
+			sig, err := a.Sign(pub, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pub.Verify(data, sig); err != nil {
+				t.Errorf("Signature doesn't verify: %s", err)
+			}
+		})
+	}
+}
+
+func TestFIDO2RegisterSelectsDevice(t *testing.T) {
+	first, second := ctap2test.New(""), ctap2test.New("")
+	first.Touch = make(chan struct{})
+	second.Touch = make(chan struct{})
+	fakeDevices(t, "", first, second)
+	a := newTestAgent(t, false)
+
+	// Once both are waiting, touch the second device to select it, then to
+	// create the credential
+	go func() {
+		for len(first.Requests()) < 2 || len(second.Requests()) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		second.Touch <- struct{}{}
+		second.Touch <- struct{}{}
+	}()
+
+	register(t, a, SKRegisterRequest{Application: "ssh:", Algorithm: "ed25519"})
+	if len(first.Credentials()) != 0 || len(second.Credentials()) != 1 {
+		t.Errorf("Created %d and %d credentials", len(first.Credentials()), len(second.Credentials()))
+	}
+}
+
+// waitLoaded waits for resident keys to finish loading
+func waitLoaded(a *u2fAgent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.residentLoading {
+		a.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		a.mu.Lock()
+	}
+}
+
+func TestFIDO2ResidentKeys(t *testing.T) {
+	auth := ctap2test.New("1234")
+	prompts := fakeDevices(t, "1234", auth)
+
+	pub := register(t, newTestAgent(t, false), SKRegisterRequest{
+		Application: "ssh:",
+		Comment:     "resident",
+		Algorithm:   "ed25519",
+		Resident:    true,
+	})
+	*prompts = 0
+
+	// A fresh agent finds the key on the device, without holding up List
+	a := newTestAgent(t, true)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys := skKeys(t, a)
+		if len(keys) == 1 && string(keys[0].Blob) == string(pub.Marshal()) {
+			if keys[0].Comment != "resident" {
+				t.Errorf("Listed comment %q", keys[0].Comment)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Resident key not listed: %v", keys)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitLoaded(a)
+
+	sig, err := a.Sign(pub, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Verify([]byte("data"), sig); err != nil {
+		t.Errorf("Signature doesn't verify: %s", err)
+	}
+
+	// The PIN is only asked for once per device
+	a.List()
+	waitLoaded(a)
+	if *prompts != 1 {
+		t.Errorf("Prompted for the PIN %d times", *prompts)
+	}
+}
+
+func TestSKRegisterAppIDs(t *testing.T) {
+	auth := ctap2test.New("")
+	fakeDevices(t, "", auth)
+
+	a := newTestAgent(t, false)
+	a.appIDs = newAppIDSet([]string{"ssh:"})
+	a.remoteAppIDs = newAppIDSet([]string{"ssh:work"})
+
+	for _, c := range []struct {
+		application string
+		agent       agent.ExtendedAgent
+	}{
+		{"ssh:work", lib.NewSessionAgent(a)},
+		{"ssh:", lib.NewRemoteSessionAgent(a)},
+	} {
+		for _, alg := range []string{"ecdsa", "ed25519"} {
+			req := SKRegisterRequest{Application: c.application, Algorithm: alg}
+			if _, err := c.agent.Extension(SKRegisterExtension, ssh.Marshal(&req)); err == nil {
+				t.Errorf("Registered %s key for %s", alg, c.application)
+			}
+		}
+	}
+
+	// The devices weren't touched
+	if len(auth.Requests()) != 0 {
+		t.Errorf("Sent %d requests", len(auth.Requests()))
+	}
+
+	register(t, a, SKRegisterRequest{Application: "ssh:", Algorithm: "ed25519"})
+}
@@ -0,0 +1,124 @@
+package u2fagent
+
+import (
+	"path"
+	"strconv"
+
+	"github.com/flynn/hid"
+	"github.com/pkg/errors"
+)
+
+// deviceRule selects devices by their USB IDs, product string or serial
+// number. Empty fields match any device
+type deviceRule struct {
+	// VendorID and ProductID are hexadecimal USB IDs, e.g. "1050"
+	VendorID  string `json:"vendor_id"`
+	ProductID string `json:"product_id"`
+	// Product and Serial are patterns as accepted by path.Match
+	Product string `json:"product"`
+	Serial  string `json:"serial"`
+	// Exclude hides matching devices
+	Exclude bool `json:"exclude"`
+	// Comment replaces the product string when listing matching devices
+	Comment string `json:"comment"`
+
+	vendorID, productID uint16
+}
+
+func parseUSBID(id string) (uint16, error) {
+	v, err := strconv.ParseUint(id, 16, 16)
+	if err != nil {
+		return 0, errors.Errorf("Invalid USB ID %q", id)
+	}
+	return uint16(v), nil
+}
+
+func (r *deviceRule) parse() (err error) {
+	if r.VendorID != "" {
+		if r.vendorID, err = parseUSBID(r.VendorID); err != nil {
+			return err
+		}
+	}
+	if r.ProductID != "" {
+		if r.productID, err = parseUSBID(r.ProductID); err != nil {
+			return err
+		}
+	}
+	if _, err := path.Match(r.Product, ""); err != nil {
+		return errors.Wrapf(err, "Invalid product pattern %q", r.Product)
+	}
+	if _, err := path.Match(r.Serial, ""); err != nil {
+		return errors.Wrapf(err, "Invalid serial pattern %q", r.Serial)
+	}
+	return nil
+}
+
+func (r *deviceRule) match(dev *hid.DeviceInfo) bool {
+	if r.VendorID != "" && dev.VendorID != r.vendorID {
+		return false
+	}
+	if r.ProductID != "" && dev.ProductID != r.productID {
+		return false
+	}
+	if r.Product != "" {
+		if ok, _ := path.Match(r.Product, dev.Product); !ok {
+			return false
+		}
+	}
+	if r.Serial != "" {
+		if ok, _ := path.Match(r.Serial, deviceSerial(dev)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rule returns the first rule matching dev, or nil
+func (self *u2fAgent) rule(dev *hid.DeviceInfo) *deviceRule {
+	for i := range self.rules {
+		if self.rules[i].match(dev) {
+			return &self.rules[i]
+		}
+	}
+	return nil
+}
+
+// allowed returns whether dev may be used. If there are any rules which
+// include devices, devices must match one of them
+func (self *u2fAgent) allowed(dev *hid.DeviceInfo) bool {
+	if r := self.rule(dev); r != nil {
+		return !r.Exclude
+	}
+
+	for _, r := range self.rules {
+		if !r.Exclude {
+			return false
+		}
+	}
+	return true
+}
+
+// comment returns the name to list a device under
+func (self *u2fAgent) comment(dev *hid.DeviceInfo) string {
+	if r := self.rule(dev); r != nil && r.Comment != "" {
+		return r.Comment
+	}
+	return dev.Product
+}
+
+// devices enumerates the connected devices we are permitted to use
+func (self *u2fAgent) devices() ([]*hid.DeviceInfo, error) {
+	all, err := enumerateDevices()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error enumerating U2F devices")
+	}
+	self.pool.prune(all)
+
+	var devices []*hid.DeviceInfo
+	for _, dev := range all {
+		if self.allowed(dev) {
+			devices = append(devices, dev)
+		}
+	}
+	return devices, nil
+}
@@ -0,0 +1,203 @@
+package u2fagent
+
+import (
+	"log"
+	"sync"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/flynn/hid"
+	"github.com/flynn/u2f/u2ftoken"
+	"github.com/pkg/errors"
+)
+
+// pooledDevice is a device kept open between requests. Requests to it,
+// U2F or CTAP2, are serialised, so concurrent clients don't interleave on
+// its channel
+type pooledDevice struct {
+	mu   sync.Mutex
+	info *hid.DeviceInfo
+
+	// dev is guarded by devMu as well as mu, so that Cancel needn't wait
+	// for the request it cancels. removed is set once the device has left
+	// the pool; it is then closed and not reopened
+	devMu   sync.Mutex
+	dev     *ctap2.HIDDevice
+	removed bool
+}
+
+var _ u2ftoken.Device = &pooledDevice{}
+
+func (d *pooledDevice) setDev(dev *ctap2.HIDDevice) {
+	d.devMu.Lock()
+	defer d.devMu.Unlock()
+	d.dev = dev
+}
+
+func (d *pooledDevice) isRemoved() bool {
+	d.devMu.Lock()
+	defer d.devMu.Unlock()
+	return d.removed
+}
+
+// request runs f with the device open. If it fails we close the device,
+// so the next request reopens it, allocating a new HID channel; if retry
+// is set that happens at once
+func (d *pooledDevice) request(retry bool, f func(dev *ctap2.HIDDevice) ([]byte, error)) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if d.isRemoved() {
+			return nil, errors.Errorf("%s was removed", d.info.Product)
+		}
+
+		if d.dev == nil {
+			dev, err := openHID(d.info)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Opening %s", d.info.Product)
+			}
+			d.setDev(dev)
+		}
+
+		resp, err := f(d.dev)
+		if err == nil {
+			return resp, nil
+		}
+
+		d.dev.Close()
+		d.setDev(nil)
+		if !retry || attempt > 0 {
+			return nil, err
+		}
+		log.Printf("Error talking to %s, reinitialising: %s", d.info.Product, err)
+	}
+}
+
+// Message sends a U2F request to the device, retrying once on failure
+func (d *pooledDevice) Message(data []byte) ([]byte, error) {
+	return d.request(true, func(dev *ctap2.HIDDevice) ([]byte, error) {
+		return dev.Message(data)
+	})
+}
+
+// CBOR sends a CTAP2 request to the device, calling onPresenceNeeded
+// (which may be nil) if it waits for the user. CTAP2 requests may have
+// prompted the user, so aren't retried
+func (d *pooledDevice) CBOR(data []byte, onPresenceNeeded func()) ([]byte, error) {
+	return d.request(false, func(dev *ctap2.HIDDevice) ([]byte, error) {
+		dev.OnPresenceNeeded = onPresenceNeeded
+		defer func() { dev.OnPresenceNeeded = nil }()
+		return dev.CBOR(data)
+	})
+}
+
+// Cancel cancels the request in progress, if any
+func (d *pooledDevice) Cancel() {
+	d.devMu.Lock()
+	defer d.devMu.Unlock()
+
+	if d.dev != nil {
+		d.dev.Cancel()
+	}
+}
+
+// supportsCBOR returns whether the device speaks CTAP2
+func (d *pooledDevice) supportsCBOR() (bool, error) {
+	var cbor bool
+	_, err := d.request(true, func(dev *ctap2.HIDDevice) ([]byte, error) {
+		cbor = dev.SupportsCBOR()
+		return nil, nil
+	})
+	return cbor, err
+}
+
+// remove takes the device out of use. Requests already using it finish
+// before it is closed, which happens in the background unless wait is set
+func (d *pooledDevice) remove(wait bool) {
+	d.devMu.Lock()
+	d.removed = true
+	d.devMu.Unlock()
+
+	if wait {
+		d.close()
+	} else {
+		go d.close()
+	}
+}
+
+func (d *pooledDevice) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dev != nil {
+		d.dev.Close()
+		d.setDev(nil)
+	}
+}
+
+// devicePool holds the devices we have open, keyed by device identity
+type devicePool struct {
+	mu      sync.Mutex
+	devices map[string]*pooledDevice
+}
+
+// get returns the pooled device for info, opening it if necessary
+func (p *devicePool) get(info *hid.DeviceInfo) (*pooledDevice, error) {
+	identity := deviceIdentity(info)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if d, ok := p.devices[identity]; ok {
+		if d.info.Path == info.Path {
+			return d, nil
+		}
+
+		// Replugged elsewhere. The old device is closed once any request
+		// using it has finished; later ones fail rather than reopening it
+		delete(p.devices, identity)
+		d.remove(false)
+	}
+
+	dev, err := openHID(info)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Opening %s", info.Product)
+	}
+
+	if p.devices == nil {
+		p.devices = make(map[string]*pooledDevice)
+	}
+	d := &pooledDevice{info: info, dev: dev}
+	p.devices[identity] = d
+	return d, nil
+}
+
+// closeAll closes every device
+func (p *devicePool) closeAll() {
+	p.mu.Lock()
+	devices := p.devices
+	p.devices = nil
+	p.mu.Unlock()
+
+	for _, d := range devices {
+		d.remove(true)
+	}
+}
+
+// prune closes devices which are no longer connected
+func (p *devicePool) prune(present []*hid.DeviceInfo) {
+	paths := make(map[string]bool)
+	for _, info := range present {
+		paths[info.Path] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for identity, d := range p.devices {
+		if !paths[d.info.Path] {
+			delete(p.devices, identity)
+			d.remove(false)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package u2fagent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/ctap2"
+	"github.com/erincandescent/ssh-emissary/ctap2/ctap2test"
+)
+
+func TestPoolRemoveInUse(t *testing.T) {
+	auth := ctap2test.New("")
+	auth.Touch = make(chan struct{})
+	fakeDevices(t, "", auth)
+
+	a := NewAgent().(*u2fAgent)
+	devices, err := a.openFIDO2Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := devices[0]
+
+	// Unplug the device while a request waits for the user
+	done := make(chan error)
+	go func() { done <- d.client.Select() }()
+	for len(auth.Requests()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	a.pool.prune(nil)
+
+	// The request isn't cut off
+	auth.Touch <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// but the device isn't reopened for the next one
+	if _, err := d.client.GetInfo(); err == nil {
+		t.Error("Removed device was reopened")
+	}
+	if _, err := d.dev.Message([]byte{0x00, insVersion, 0x00, 0x00, 0x00}); err == nil {
+		t.Error("Removed device was reopened")
+	}
+}
+
+func TestPoolSharedChannel(t *testing.T) {
+	auth := ctap2test.New("")
+	fakeDevices(t, "", auth)
+
+	a := NewAgent().(*u2fAgent)
+	devices, err := a.openFIDO2Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u2f, err := a.openDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2f[0].dev != devices[0].dev {
+		t.Fatal("U2F and CTAP2 requests use different devices")
+	}
+
+	// Concurrent U2F and CTAP2 requests don't interleave on the channel
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := devices[0].client.GetInfo()
+			errs <- err
+		}()
+		go func() {
+			resp, err := u2f[0].dev.Message([]byte{0x00, insVersion, 0x00, 0x00, 0x00})
+			if err == nil && statusWord(resp) != 0x6d00 {
+				err = ctap2.Status(resp[0])
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package u2fagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Test vectors from docs/protocol.md
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestKeyBlob(t *testing.T) {
+	tag := make([]byte, 40)
+	for i := range tag {
+		if i < 24 {
+			tag[i] = byte(i)
+		} else {
+			tag[i] = 0xaa
+		}
+	}
+
+	want := unhex(`0000000a753266406534332e6575000102030405060708090a0b0c0d0e0f10111213
+		14151617aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`)
+	got := ssh.Marshal(&wireKey{Format: u2fproto.KeyFormat, Rest: tag})
+	if !bytes.Equal(got, want) {
+		t.Errorf("Got key blob\n%x\nwant\n%x", got, want)
+	}
+}
+
+// exchange sends a request to a, served as the agent protocol, and
+// returns the response
+func exchange(t *testing.T, a agent.Agent, req []byte) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go agent.ServeAgent(lib.NewSessionAgent(a), server)
+
+	if _, err := client.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(client, length[:]); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 4+binary.BigEndian.Uint32(length[:]))
+	copy(res, length[:])
+	if _, err := io.ReadFull(client, res[4:]); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestVersionExchange(t *testing.T) {
+	a := NewAgent()
+
+	res := exchange(t, a, unhex(`0000001f1b000000127532662d76657273696f6e406534332e6575
+		0000000100000002`))
+	if want := unhex("000000050600000002"); !bytes.Equal(res, want) {
+		t.Errorf("Got version response %x, want %x", res, want)
+	}
+
+	// A client only speaking version 3 and later
+	res = exchange(t, a, unhex(`0000001f1b000000127532662d76657273696f6e406534332e6575
+		0000000300000004`))
+	if want := unhex("000000011c"); !bytes.Equal(res, want) {
+		t.Errorf("Got version response %x, want %x", res, want)
+	}
+}
+
+func TestWaitExchange(t *testing.T) {
+	fakeDevices(t, "")
+
+	// The test vector's key wasn't listed by this agent
+	res := exchange(t, NewAgent(), unhex(`0000005d1b0000000f7532662d77616974406534332e6575000000360000000a753266
+		406534332e6575000102030405060708090a0b0c0d0e0f1011121314151617aaaaaaaa
+		aaaaaaaaaaaaaaaaaaaaaaaa000000070003000000000000000000`))
+	if want := unhex("0000000105"); !bytes.Equal(res, want) {
+		t.Errorf("Got wait response %x, want %x", res, want)
+	}
+}
@@ -0,0 +1,84 @@
+package u2fagent
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/hid"
+)
+
+// deviceSerial finds the USB serial number of a device through sysfs.
+// Devices may be named by hidraw node or by usbfs path
+func deviceSerial(dev *hid.DeviceInfo) string {
+	if strings.HasPrefix(dev.Path, "/dev/hidraw") {
+		return hidrawSerial(filepath.Base(dev.Path))
+	}
+
+	// /dev/bus/usb/<bus>/<device>, optionally followed by an interface
+	if strings.HasPrefix(dev.Path, "/dev/bus/usb/") {
+		parts := strings.Split(strings.TrimPrefix(dev.Path, "/dev/bus/usb/"), "/")
+		if len(parts) < 2 {
+			return ""
+		}
+		bus, err1 := strconv.Atoi(parts[0])
+		devnum, err2 := strconv.Atoi(strings.SplitN(parts[1], ":", 2)[0])
+		if err1 != nil || err2 != nil {
+			return ""
+		}
+		return usbfsSerial(bus, devnum)
+	}
+	return ""
+}
+
+func hidrawSerial(node string) string {
+	f, err := os.Open(filepath.Join("/sys/class/hidraw", node, "device/uevent"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "HID_UNIQ=") {
+			return strings.TrimPrefix(s.Text(), "HID_UNIQ=")
+		}
+	}
+	return ""
+}
+
+func readSysfsInt(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func usbfsSerial(bus, devnum int) string {
+	dirs, err := filepath.Glob("/sys/bus/usb/devices/*")
+	if err != nil {
+		return ""
+	}
+
+	for _, dir := range dirs {
+		if readSysfsInt(filepath.Join(dir, "busnum")) != bus ||
+			readSysfsInt(filepath.Join(dir, "devnum")) != devnum {
+			continue
+		}
+
+		serial, err := ioutil.ReadFile(filepath.Join(dir, "serial"))
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(serial))
+	}
+	return ""
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package u2fagent
+
+import (
+	"github.com/flynn/hid"
+)
+
+// deviceSerial is only implemented on Linux
+func deviceSerial(dev *hid.DeviceInfo) string {
+	return ""
+}
@@ -0,0 +1,424 @@
+package u2fagent
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/notify"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
+	"github.com/flynn/hid"
+	"github.com/flynn/u2f/u2ftoken"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// OpenSSH security key formats served by this backend
+const (
+	SKECDSAFormat   = "sk-ecdsa-sha2-nistp256@openssh.com"
+	SKEd25519Format = "sk-ssh-ed25519@openssh.com"
+)
+
+// SKRegisterExtension registers a new security key, storing its key
+// handle in the agent. See SKRegisterRequest and SKRegisterResponse
+const SKRegisterExtension = "sk-register@e43.eu"
+
+// SKRegisterRequest is the body of a SKRegisterExtension request
+type SKRegisterRequest struct {
+	// Application is the OpenSSH application string, normally "ssh:"
+	Application string
+	Comment     string
+	// Algorithm is "ecdsa" or "ed25519". Ed25519 needs a FIDO2 device
+	Algorithm string
+	// Resident requests a discoverable credential on a FIDO2 device
+	Resident bool
+}
+
+// SKRegisterResponse is the body of a SKRegisterExtension response
+type SKRegisterResponse struct {
+	// PublicKey is the new key in SSH wire format
+	PublicKey []byte
+}
+
+// presenceTimeout is how long we wait for the user to touch a device
+const presenceTimeout = 30 * time.Second
+
+// skKey is a registered security key
+type skKey struct {
+	Application string `json:"application"`
+	// KeyHandle is the U2F key handle or CTAP2 credential ID
+	KeyHandle []byte `json:"key_handle"`
+	// PublicKey is an uncompressed P-256 point or an Ed25519 key
+	PublicKey []byte `json:"public_key"`
+	Comment   string `json:"comment"`
+	// Algorithm is empty for ECDSA keys, or "ed25519"
+	Algorithm string `json:"algorithm,omitempty"`
+	// CTAP2 is set for keys which must be used through CTAP2
+	CTAP2 bool `json:"ctap2,omitempty"`
+}
+
+type skECDSAWireKey struct {
+	Type        string
+	Curve       string
+	Q           []byte
+	Application string
+}
+
+type skEd25519WireKey struct {
+	Type        string
+	PublicKey   []byte
+	Application string
+}
+
+func (k *skKey) sshType() string {
+	if k.Algorithm == "ed25519" {
+		return SKEd25519Format
+	}
+	return SKECDSAFormat
+}
+
+func (k *skKey) Marshal() []byte {
+	if k.Algorithm == "ed25519" {
+		return ssh.Marshal(&skEd25519WireKey{
+			Type:        SKEd25519Format,
+			PublicKey:   k.PublicKey,
+			Application: k.Application,
+		})
+	}
+
+	return ssh.Marshal(&skECDSAWireKey{
+		Type:        SKECDSAFormat,
+		Curve:       "nistp256",
+		Q:           k.PublicKey,
+		Application: k.Application,
+	})
+}
+
+// skStore persists registered security keys
+type skStore struct {
+	mu   sync.Mutex
+	path string
+	keys []*skKey
+}
+
+func loadSKStore(file string) (*skStore, error) {
+	if file == "" {
+		dir, err := lib.StateDir()
+		if err != nil {
+			return nil, err
+		}
+		file = path.Join(dir, "sk-keys.json")
+	}
+
+	store := &skStore{path: file}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Reading %s", file)
+	}
+
+	if err := json.Unmarshal(data, &store.keys); err != nil {
+		return nil, errors.Wrapf(err, "Parsing %s", file)
+	}
+	return store, nil
+}
+
+func (self *skStore) add(k *skKey) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	data, err := json.MarshalIndent(append(self.keys, k), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := self.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "Writing %s", tmp)
+	}
+	if err := os.Rename(tmp, self.path); err != nil {
+		return err
+	}
+
+	self.keys = append(self.keys, k)
+	return nil
+}
+
+// list returns a copy of the stored keys, which the caller may append to
+func (self *skStore) list() []*skKey {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]*skKey(nil), self.keys...)
+}
+
+// findSK finds a stored or resident key by its blob
+func (self *u2fAgent) findSK(blob []byte) *skKey {
+	for _, k := range self.skKeys.list() {
+		if string(k.Marshal()) == string(blob) {
+			return k
+		}
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, keys := range self.resident {
+		for _, k := range keys {
+			if string(k.Marshal()) == string(blob) {
+				return k
+			}
+		}
+	}
+	return nil
+}
+
+type openDevice struct {
+	info *hid.DeviceInfo
+	dev  *pooledDevice
+}
+
+func (self *u2fAgent) openDevices() ([]openDevice, error) {
+	infos, err := self.devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []openDevice
+	for _, info := range infos {
+		dev, err := self.pool.get(info)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		devices = append(devices, openDevice{info, dev})
+	}
+
+	if len(devices) == 0 {
+		return nil, errors.New("No U2F devices found")
+	}
+	return devices, nil
+}
+
+// skRegister registers a new key on whichever device the user touches first
+func (self *u2fAgent) skRegister(s *lib.Session, req SKRegisterRequest) (*skKey, error) {
+	app := sha256.Sum256([]byte(req.Application))
+	if err := self.checkAppID(app, s.Forwarded()); err != nil {
+		return nil, err
+	}
+
+	devices, err := self.openDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return nil, err
+	}
+
+	waiter := notify.Start("Touch your security key", "Registering a new SSH key")
+	defer waiter.Done()
+
+	deadline := time.Now().Add(presenceTimeout)
+	for time.Now().Before(deadline) {
+		for _, d := range devices {
+			tok := u2ftoken.NewToken(d.dev)
+			res, err := tok.Register(u2ftoken.RegisterRequest{
+				Challenge:   challenge,
+				Application: app[:],
+			})
+			if err == u2ftoken.ErrPresenceRequired {
+				continue
+			} else if err != nil {
+				log.Printf("Error registering with %s: %s", d.info.Product, err)
+				continue
+			}
+
+			// 0x05 | public key (65) | key handle length | key handle | ...
+			if len(res) < 67 || len(res) < 67+int(res[66]) {
+				return nil, errors.New("Short registration response")
+			}
+
+			comment := req.Comment
+			if comment == "" {
+				comment = self.comment(d.info)
+			}
+
+			return &skKey{
+				Application: req.Application,
+				PublicKey:   res[1:66],
+				KeyHandle:   res[67 : 67+int(res[66])],
+				Comment:     comment,
+			}, nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil, errors.New("Timed out waiting for user presence")
+}
+
+// skSign produces an OpenSSH security key signature of data
+func (self *u2fAgent) skSign(k *skKey, data []byte) (*ssh.Signature, error) {
+	devices, err := self.openDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	app := sha256.Sum256([]byte(k.Application))
+	challenge := sha256.Sum256(data)
+	req := u2ftoken.AuthenticateRequest{
+		Challenge:   challenge[:],
+		Application: app[:],
+		KeyHandle:   k.KeyHandle,
+	}
+
+	var tok *u2ftoken.Token
+	for _, d := range devices {
+		t := u2ftoken.NewToken(d.dev)
+		if err := t.CheckAuthenticate(req); err == nil {
+			tok = t
+			break
+		} else if err != u2ftoken.ErrUnknownKeyHandle {
+			log.Printf("Error checking %s: %s", d.info.Product, err)
+		}
+	}
+	if tok == nil {
+		return nil, errors.New("Device not found")
+	}
+
+	waiter := notify.Start("Touch your security key", k.Comment+" is waiting for you")
+	defer waiter.Done()
+
+	deadline := time.Now().Add(presenceTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := tok.Authenticate(req)
+		if err == u2ftoken.ErrPresenceRequired {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var sig struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(resp.Signature, &sig); err != nil {
+			return nil, errors.Wrap(err, "Error unmarshalling signature")
+		}
+
+		// The signature is followed by the flags and counter
+		rest := resp.RawResponse[:5]
+		return &ssh.Signature{
+			Format: SKECDSAFormat,
+			Blob:   ssh.Marshal(&sig),
+			Rest:   append([]byte(nil), rest...),
+		}, nil
+	}
+	return nil, errors.New("Timed out waiting for user presence")
+}
+
+func (self *u2fAgent) skList() (keys []*agent.Key) {
+	all := self.skKeys.list()
+
+	if self.loadResident {
+		self.mu.Lock()
+		for _, rk := range self.resident {
+			all = append(all, rk...)
+		}
+		if !self.residentLoading {
+			self.residentLoading = true
+			go self.loadResidentKeys()
+		}
+		self.mu.Unlock()
+	}
+
+	seen := make(map[string]bool)
+	for _, k := range all {
+		if k.Algorithm == "" {
+			if x, _ := elliptic.Unmarshal(elliptic.P256(), k.PublicKey); x == nil {
+				continue
+			}
+		}
+
+		blob := k.Marshal()
+		if seen[string(blob)] {
+			continue
+		}
+		seen[string(blob)] = true
+
+		keys = append(keys, &agent.Key{
+			Format:  k.sshType(),
+			Blob:    blob,
+			Comment: k.Comment,
+		})
+	}
+	return keys
+}
+
+func (self *u2fAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return self.ExtensionInSession(nil, extensionType, contents)
+}
+
+func (self *u2fAgent) ExtensionInSession(s *lib.Session, extensionType string, contents []byte) ([]byte, error) {
+	switch extensionType {
+	case u2fproto.VersionExtension:
+		var req u2fproto.VersionRequest
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, err
+		}
+
+		res, err := negotiateVersion(req)
+		if err != nil {
+			return nil, err
+		}
+		return lib.ExtensionResponse(ssh.Marshal(res)), nil
+
+	case u2fproto.WaitExtension:
+		var req u2fproto.WaitRequest
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, err
+		}
+
+		res, err := self.wait(s, req)
+		if err != nil {
+			return nil, err
+		}
+		return lib.ExtensionResponse(ssh.Marshal(res)), nil
+
+	case SKRegisterExtension:
+		var req SKRegisterRequest
+		if err := ssh.Unmarshal(contents, &req); err != nil {
+			return nil, err
+		}
+
+		var k *skKey
+		var err error
+		if req.Resident || req.Algorithm == "ed25519" {
+			k, err = self.fido2Register(s, req)
+		} else {
+			k, err = self.skRegister(s, req)
+		}
+		if err != nil {
+			log.Printf("Error registering security key: %s", err)
+			return nil, err
+		}
+
+		if err := self.skKeys.add(k); err != nil {
+			log.Printf("Error storing security key: %s", err)
+			return nil, err
+		}
+		return lib.ExtensionResponse(ssh.Marshal(&SKRegisterResponse{k.Marshal()})), nil
+	}
+	return nil, agent.ErrExtensionUnsupported
+}
@@ -0,0 +1,80 @@
+package u2fagent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func ed25519SKKey(t *testing.T, comment string) *skKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &skKey{
+		Application: "ssh:",
+		KeyHandle:   []byte(comment),
+		PublicKey:   pub,
+		Comment:     comment,
+		Algorithm:   "ed25519",
+	}
+}
+
+func TestSKListWhileAdding(t *testing.T) {
+	fakeDevices(t, "")
+	a := newTestAgent(t, true)
+
+	// Pretend the resident keys have been loaded
+	a.mu.Lock()
+	a.resident["device"] = []*skKey{ed25519SKKey(t, "resident")}
+	a.residentLoading = true
+	a.mu.Unlock()
+
+	const n = 50
+	stored := make([]*skKey, n)
+	for i := range stored {
+		stored[i] = ed25519SKKey(t, fmt.Sprint("stored ", i))
+	}
+
+	// List continuously while keys are added
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				found := false
+				for _, k := range a.skList() {
+					if k.Comment == "resident" {
+						found = true
+					}
+				}
+				if !found {
+					t.Error("Resident key missing from List")
+					return
+				}
+			}
+		}()
+	}
+
+	for _, k := range stored {
+		if err := a.skKeys.add(k); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if keys := skKeys(t, a); len(keys) != n+1 {
+		t.Errorf("Listed %d keys, want %d", len(keys), n+1)
+	}
+}
@@ -0,0 +1,145 @@
+package u2fagent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/flynn/hid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// pathIdentities records the paths of devices identified by path, so that
+// each is logged once
+var pathIdentities = struct {
+	sync.Mutex
+	logged map[string]bool
+}{logged: make(map[string]bool)}
+
+// deviceIdentity returns a stable identifier for a device: its USB serial
+// number where we can find one, otherwise its path. Devices identified by
+// path get a different tag in another port
+func deviceIdentity(dev *hid.DeviceInfo) string {
+	if serial := deviceSerial(dev); serial != "" {
+		return fmt.Sprintf("serial:%04x:%04x:%s", dev.VendorID, dev.ProductID, serial)
+	}
+
+	pathIdentities.Lock()
+	if !pathIdentities.logged[dev.Path] {
+		pathIdentities.logged[dev.Path] = true
+		log.Printf("%s at %s has no serial number; its tag will change if it is plugged in elsewhere", dev.Product, dev.Path)
+	}
+	pathIdentities.Unlock()
+	return "path:" + dev.Path
+}
+
+// findDevice finds the connected device with the given identity
+func (self *u2fAgent) findDevice(identity string) (*hid.DeviceInfo, error) {
+	devices, err := self.devices()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dev := range devices {
+		if deviceIdentity(dev) == identity {
+			return dev, nil
+		}
+	}
+	return nil, errors.New("Device not found")
+}
+
+// readOrCreate reads a file of exactly size random bytes, creating it if
+// it doesn't exist
+func readOrCreate(file string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		if len(data) != size {
+			return nil, errors.Errorf("%s is corrupt", file)
+		}
+		return data, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data = make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return nil, err
+	}
+	return data, f.Close()
+}
+
+// loadTagSecrets loads the tag secrets from the state directory, creating
+// them if necessary. They are stored sealed with a key kept separately in
+// keyFile (by default, in the configuration directory)
+func (self *u2fAgent) loadTagSecrets(keyFile string) error {
+	if keyFile == "" {
+		dir, err := lib.ConfigDir()
+		if err != nil {
+			return err
+		}
+		keyFile = path.Join(dir, "u2f-tags.key")
+	}
+
+	keyBytes, err := readOrCreate(keyFile, 32)
+	if err != nil {
+		return errors.Wrap(err, "Reading tag key")
+	}
+	var key [32]byte
+	copy(key[:], keyBytes)
+
+	dir, err := lib.StateDir()
+	if err != nil {
+		return err
+	}
+	file := path.Join(dir, "u2f-tags")
+
+	sealed, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		// Save our freshly generated secrets
+		var nonce [24]byte
+		if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+			return err
+		}
+
+		secrets := append(append([]byte(nil), self.boxSecret[:]...), self.nonceKey[:]...)
+		sealed = secretbox.Seal(nonce[:], secrets, &nonce, &key)
+		if err := ioutil.WriteFile(file, sealed, 0600); err != nil {
+			return errors.Wrapf(err, "Writing %s", file)
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Reading %s", file)
+	}
+
+	if len(sealed) < 24 {
+		return errors.Errorf("%s is corrupt", file)
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	secrets, ok := secretbox.Open(nil, sealed[24:], &nonce, &key)
+	if !ok || len(secrets) != 64 {
+		return errors.Errorf("Unable to decrypt %s; was %s replaced?", file, keyFile)
+	}
+
+	copy(self.boxSecret[:], secrets[:32])
+	copy(self.nonceKey[:], secrets[32:])
+	return nil
+}
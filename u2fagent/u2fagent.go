@@ -7,10 +7,15 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"io"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/erincandescent/ssh-emissary/emissary"
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/notify"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
 	"github.com/flynn/hid"
-	"github.com/flynn/u2f/u2fhid"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/ssh"
@@ -20,12 +25,39 @@ import (
 type u2fAgent struct {
 	boxSecret [32]byte
 	nonceKey  [32]byte
+
+	// waiting tracks devices which have asked for user presence, keyed by path
+	mu      sync.Mutex
+	waiting map[string]*presenceWaiter
+
+	skKeys *skStore
+
+	// resident holds keys resident on FIDO2 devices, keyed by device path.
+	// residentLoading is set while they are being loaded
+	loadResident    bool
+	resident        map[string][]*skKey
+	residentLoading bool
+
+	// appIDs are the AppIDs local clients may use; nil permits any.
+	// remoteAppIDs are those forwarded connections may use
+	appIDs       appIDSet
+	remoteAppIDs appIDSet
+
+	// rules select which devices we use
+	rules []deviceRule
+
+	pool devicePool
 }
 
-var _ agent.Agent = &u2fAgent{}
+var _ agent.ExtendedAgent = &u2fAgent{}
+var _ lib.SessionAgent = &u2fAgent{}
 
 func NewAgent() agent.Agent {
-	agent := &u2fAgent{}
+	agent := &u2fAgent{
+		waiting:  make(map[string]*presenceWaiter),
+		skKeys:   &skStore{},
+		resident: make(map[string][]*skKey),
+	}
 	if _, err := io.ReadFull(rand.Reader, agent.boxSecret[:]); err != nil {
 		panic(err)
 	}
@@ -43,17 +75,18 @@ type wireKey struct {
 }
 
 // deviceTag generates a unique secret identifier for a device
-// We encrypt the path into a secretbox, using the path as
-// input to HMAC to produce a constant nonce.
+// We encrypt the device identity into a secretbox, using the identity
+// as input to HMAC to produce a constant nonce.
 func (self *u2fAgent) deviceTag(dev *hid.DeviceInfo) []byte {
 	var nonce [24]byte
+	identity := deviceIdentity(dev)
 
 	mac := hmac.New(sha256.New, self.nonceKey[:])
-	mac.Write([]byte(dev.Path))
+	mac.Write([]byte(identity))
 	sum := mac.Sum(nil)
 	copy(nonce[:], sum[:24])
 
-	return secretbox.Seal(nonce[:], []byte(dev.Path), &nonce, &self.boxSecret)
+	return secretbox.Seal(nonce[:], []byte(identity), &nonce, &self.boxSecret)
 }
 
 func (self *u2fAgent) tryOpenDeviceTag(tag []byte) string {
@@ -65,13 +98,13 @@ func (self *u2fAgent) tryOpenDeviceTag(tag []byte) string {
 	var nonce [24]byte
 	copy(nonce[:], tag[:24])
 
-	pathBytes, ok := secretbox.Open(nil, tag[24:], &nonce, &self.boxSecret)
+	identity, ok := secretbox.Open(nil, tag[24:], &nonce, &self.boxSecret)
 	if !ok {
 		return ""
 	}
 
 	mac := hmac.New(sha256.New, self.nonceKey[:])
-	mac.Write(pathBytes)
+	mac.Write(identity)
 	sum := mac.Sum(nil)
 	if !hmac.Equal(sum[:24], nonce[:]) {
 		// We should never be able to hit this case as the secretbox should
@@ -79,54 +112,97 @@ func (self *u2fAgent) tryOpenDeviceTag(tag []byte) string {
 		return ""
 	}
 
-	return string(pathBytes)
+	return string(identity)
+}
+
+// deviceKey returns the key blob we list a device as
+func (self *u2fAgent) deviceKey(dev *hid.DeviceInfo) []byte {
+	return ssh.Marshal(&wireKey{
+		Format: u2fproto.KeyFormat,
+		Rest:   self.deviceTag(dev),
+	})
+}
+
+// ownsKey returns whether a key blob names one of our devices, connected
+// or not
+func (self *u2fAgent) ownsKey(blob []byte) bool {
+	var wk wireKey
+	if err := ssh.Unmarshal(blob, &wk); err != nil {
+		return false
+	}
+	return wk.Format == u2fproto.KeyFormat && self.tryOpenDeviceTag(wk.Rest) != ""
+}
+
+// taggedDevice finds the device named by a key blob
+func (self *u2fAgent) taggedDevice(blob []byte) (*hid.DeviceInfo, error) {
+	var wk wireKey
+	if err := ssh.Unmarshal(blob, &wk); err != nil {
+		return nil, err
+	}
+
+	identity := self.tryOpenDeviceTag(wk.Rest)
+	if identity == "" {
+		return nil, errors.New("Device not found")
+	}
+	return self.findDevice(identity)
 }
 
 func (self *u2fAgent) List() (keys []*agent.Key, err error) {
-	devices, err := u2fhid.Devices()
+	devices, err := self.devices()
 	if err != nil {
-		return nil, errors.Wrap(err, "Error enumerating U2F devices")
+		return nil, err
 	} else {
 		for i := 0; i < len(devices); i++ {
-			wk := wireKey{
-				Format: "u2f@e43.eu",
-				Rest:   self.deviceTag(devices[i]),
-			}
-
 			keys = append(keys, &agent.Key{
 				Format:  "u2f",
-				Blob:    ssh.Marshal(&wk),
-				Comment: devices[i].Product,
+				Blob:    self.deviceKey(devices[i]),
+				Comment: self.comment(devices[i]),
 			})
 		}
 	}
+
+	keys = append(keys, self.skList()...)
 	return
 }
 
 func (self *u2fAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
-	if key.Type() == "u2f" {
-		k := key.(*agent.Key)
-		var wk wireKey
+	return self.SignInSession(nil, key, data, 0)
+}
 
-		err := ssh.Unmarshal(k.Blob, &wk)
-		if err != nil {
-			return nil, err
-		}
+func (self *u2fAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return self.SignInSession(nil, key, data, flags)
+}
 
-		path := self.tryOpenDeviceTag(wk.Rest)
-		if path == "" {
-			return nil, errors.New("Device not found")
+func (self *u2fAgent) SignInSession(s *lib.Session, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	switch key.Type() {
+	case SKECDSAFormat, SKEd25519Format:
+		if k := self.findSK(key.Marshal()); k != nil {
+			if k.CTAP2 {
+				return self.fido2Sign(k, data)
+			}
+			return self.skSign(k, data)
 		}
 
-		devinfo, err := hid.ByPath(path)
+	// Keys we listed ourselves have format "u2f"; those parsed from the
+	// wire by agent.ServeAgent have the blob's format
+	case "u2f", u2fproto.KeyFormat:
+		devinfo, err := self.taggedDevice(key.Marshal())
 		if err != nil {
 			return nil, err
 		}
-		dev, err := u2fhid.Open(devinfo)
+
+		if err := self.checkAPDU(data, s.Forwarded()); err != nil {
+			log.Printf("Refusing U2F request: %s", err)
+			return nil, err
+		}
+
+		dev, err := self.pool.get(devinfo)
 		if err != nil {
 			return nil, err
 		}
+
 		resp, err := dev.Message(data)
+		self.trackPresence(devinfo, resp)
 		if err != nil {
 			return nil, err
 		}
@@ -140,6 +216,59 @@ func (self *u2fAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, erro
 	return nil, errors.New("Couldn't find key")
 }
 
+// statusWord returns the status word which ends a U2F response
+func statusWord(resp []byte) int {
+	if len(resp) < 2 {
+		return 0
+	}
+	return int(resp[len(resp)-2])<<8 | int(resp[len(resp)-1])
+}
+
+// presenceExpiry is how long after a client last polled a device waiting
+// for a touch we assume it has given up
+const presenceExpiry = 5 * time.Second
+
+// presenceWaiter notifies the user about a device waiting for a touch,
+// until the client stops polling it
+type presenceWaiter struct {
+	waiter *notify.Waiter
+	expiry *time.Timer
+}
+
+// trackPresence notifies the user while the client is polling a device
+// which is waiting for a touch
+func (self *u2fAgent) trackPresence(dev *hid.DeviceInfo, resp []byte) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	pw := self.waiting[dev.Path]
+	if statusWord(resp) == statusPresenceRequired {
+		if pw != nil {
+			pw.expiry.Reset(presenceExpiry)
+			return
+		}
+
+		pw = &presenceWaiter{waiter: notify.Start("Touch your security key",
+			self.comment(dev)+" is waiting for you")}
+		pw.expiry = time.AfterFunc(presenceExpiry, func() {
+			self.mu.Lock()
+			defer self.mu.Unlock()
+			if self.waiting[dev.Path] == pw {
+				pw.waiter.Done()
+				delete(self.waiting, dev.Path)
+			}
+		})
+		self.waiting[dev.Path] = pw
+		return
+	}
+
+	if pw != nil {
+		pw.expiry.Stop()
+		pw.waiter.Done()
+		delete(self.waiting, dev.Path)
+	}
+}
+
 func (self *u2fAgent) Add(key agent.AddedKey) error {
 	return errors.New("Can't add keys to U2F agent")
 }
@@ -156,6 +285,12 @@ func (self *u2fAgent) Lock(passphrase []byte) error {
 	return nil
 }
 
+// Close closes the devices we hold open
+func (self *u2fAgent) Close() error {
+	self.pool.closeAll()
+	return nil
+}
+
 func (self *u2fAgent) Unlock(passphrase []byte) error {
 	return nil
 }
@@ -164,8 +299,56 @@ func (self *u2fAgent) Signers() ([]ssh.Signer, error) {
 	return nil, errors.New("Not implemented")
 }
 
+type u2fConfig struct {
+	// SKKeys is the file registered security keys are stored in
+	SKKeys string `json:"sk_keys"`
+	// ResidentKeys enables listing SSH keys resident on FIDO2 devices
+	ResidentKeys bool `json:"resident_keys"`
+	// PersistTags keeps device tags stable across restarts
+	PersistTags bool `json:"persist_tags"`
+	// TagKeyFile holds the key the tag secrets are encrypted with
+	TagKeyFile string `json:"tag_key_file"`
+	// AppIDs restricts the AppIDs local clients may use
+	AppIDs []string `json:"appids"`
+	// RemoteAppIDs lists the AppIDs forwarded connections may use
+	RemoteAppIDs []string `json:"remote_appids"`
+	// Devices selects which devices are used, and what they are called
+	Devices []deviceRule `json:"devices"`
+}
+
 func u2fFactory(params json.RawMessage) (agent.Agent, error) {
-	return NewAgent(), nil
+	var config u2fConfig
+	if len(params) != 0 {
+		if err := json.Unmarshal(params, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	a := NewAgent().(*u2fAgent)
+	a.loadResident = config.ResidentKeys
+	for i := range config.Devices {
+		if err := config.Devices[i].parse(); err != nil {
+			return nil, errors.Wrapf(err, "Device rule %d", i)
+		}
+	}
+	a.rules = config.Devices
+	a.remoteAppIDs = newAppIDSet(config.RemoteAppIDs)
+	if config.AppIDs != nil {
+		a.appIDs = newAppIDSet(config.AppIDs)
+	}
+
+	var err error
+	a.skKeys, err = loadSKStore(config.SKKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PersistTags {
+		if err := a.loadTagSecrets(config.TagKeyFile); err != nil {
+			return nil, errors.Wrap(err, "Loading tag secrets")
+		}
+	}
+	return a, nil
 }
 
 func init() {
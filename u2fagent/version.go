@@ -0,0 +1,20 @@
+package u2fagent
+
+import (
+	"github.com/erincandescent/ssh-emissary/u2fproto"
+	"github.com/pkg/errors"
+)
+
+// negotiateVersion picks the highest version within the client's range
+func negotiateVersion(req u2fproto.VersionRequest) (*u2fproto.VersionResponse, error) {
+	version := uint32(u2fproto.ProtocolVersion)
+	if req.MaxVersion < version {
+		version = req.MaxVersion
+	}
+
+	if version < u2fproto.ProtocolVersion1 || version < req.MinVersion {
+		return nil, errors.Errorf("No common protocol version (client supports %d to %d)",
+			req.MinVersion, req.MaxVersion)
+	}
+	return &u2fproto.VersionResponse{Version: version}, nil
+}
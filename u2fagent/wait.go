@@ -0,0 +1,125 @@
+package u2fagent
+
+import (
+	"log"
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
+	"github.com/flynn/hid"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// maxWaitTimeout bounds the timeout clients may request
+const maxWaitTimeout = 2 * time.Minute
+
+// U2F status words
+const (
+	statusNoError          = 0x9000
+	statusPresenceRequired = 0x6985
+)
+
+// p1CheckOnly is the authenticate control byte which checks a key handle
+// without signing
+const p1CheckOnly = 0x07
+
+// needsPresence returns whether a request will be refused with
+// statusPresenceRequired until the user touches the device. Check-only
+// authenticate requests return that status to mean the key handle is valid
+func needsPresence(apdu []byte) bool {
+	ins, _, err := parseAPDU(apdu)
+	if err != nil {
+		return false
+	}
+	return ins == insRegister || (ins == insAuthenticate && apdu[2] != p1CheckOnly)
+}
+
+func (self *u2fAgent) wait(s *lib.Session, req u2fproto.WaitRequest) (*u2fproto.WaitResponse, error) {
+	// Keys listed by another backend are for it to answer
+	if len(req.Key) != 0 && !self.ownsKey(req.Key) {
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	if err := self.checkAPDU(req.Message, s.Forwarded()); err != nil {
+		log.Printf("Refusing U2F request: %s", err)
+		return nil, err
+	}
+
+	var infos []*hid.DeviceInfo
+	if len(req.Key) == 0 {
+		var err error
+		infos, err = self.devices()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		info, err := self.taggedDevice(req.Key)
+		if err != nil {
+			return nil, err
+		}
+		infos = []*hid.DeviceInfo{info}
+	}
+
+	var devices []openDevice
+	for _, info := range infos {
+		dev, err := self.pool.get(info)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		devices = append(devices, openDevice{info, dev})
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("No U2F devices found")
+	}
+	defer func() {
+		for _, d := range devices {
+			self.trackPresence(d.info, nil)
+		}
+	}()
+
+	timeout := presenceTimeout
+	if req.Timeout != 0 {
+		timeout = time.Duration(req.Timeout) * time.Millisecond
+		if timeout > maxWaitTimeout {
+			timeout = maxWaitTimeout
+		}
+	}
+
+	presence := needsPresence(req.Message)
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, d := range devices {
+			resp, err := d.dev.Message(req.Message)
+			self.trackPresence(d.info, resp)
+			if err != nil {
+				if len(req.Key) != 0 {
+					return nil, err
+				}
+				log.Printf("Error talking to %s: %s", d.info.Product, err)
+				continue
+			}
+
+			status := statusWord(resp)
+			if presence && status == statusPresenceRequired {
+				continue
+			}
+
+			// When asking every device, only a success is an answer
+			if len(req.Key) == 0 && status != statusNoError {
+				continue
+			}
+
+			return &u2fproto.WaitResponse{
+				Key:      self.deviceKey(d.info),
+				Response: resp,
+			}, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, errors.New("Timed out waiting for user presence")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,36 @@
+package u2fagent
+
+import (
+	"testing"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
+	"github.com/flynn/hid"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestWaitForeignKey(t *testing.T) {
+	fakeDevices(t, "")
+	a := NewAgent().(*u2fAgent)
+	other := NewAgent().(*u2fAgent)
+	info := &hid.DeviceInfo{Path: "a", Product: "Fake U2F", SerialNumber: "a"}
+
+	// Another backend's key is left for it to answer, even through a
+	// composite agent
+	req := u2fproto.WaitRequest{
+		Key:     other.deviceKey(info),
+		Message: []byte{0x00, insVersion, 0x00, 0x00, 0x00},
+	}
+	_, err := lib.ExtensionInSession(a, nil, u2fproto.WaitExtension, ssh.Marshal(&req))
+	if err != agent.ErrExtensionUnsupported {
+		t.Errorf("Got %v for a foreign key", err)
+	}
+
+	// Our own key for a device which has gone is an error
+	req.Key = a.deviceKey(info)
+	_, err = lib.ExtensionInSession(a, nil, u2fproto.WaitExtension, ssh.Marshal(&req))
+	if err == nil || err == agent.ErrExtensionUnsupported {
+		t.Errorf("Got %v for a missing device", err)
+	}
+}
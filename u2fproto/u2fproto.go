@@ -0,0 +1,57 @@
+// Package u2fproto defines the messages of the u2f@e43.eu agent protocol,
+// which are shared by the agent and its clients (see docs/protocol.md)
+package u2fproto
+
+// Versions of the protocol
+const (
+	// ProtocolVersion1 is spoken by agents without VersionExtension
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 adds WaitExtension and VersionExtension
+	ProtocolVersion2 = 2
+
+	// ProtocolVersion is the newest version we support
+	ProtocolVersion = ProtocolVersion2
+)
+
+// KeyFormat is the format of the key blobs U2F devices are listed with
+const KeyFormat = "u2f@e43.eu"
+
+// VersionExtension negotiates the protocol version. See VersionRequest and
+// VersionResponse
+const VersionExtension = "u2f-version@e43.eu"
+
+// VersionRequest is the body of a VersionExtension request
+type VersionRequest struct {
+	MinVersion uint32
+	MaxVersion uint32
+}
+
+// VersionResponse is the body of a VersionExtension response
+type VersionResponse struct {
+	Version uint32
+}
+
+// WaitExtension performs a U2F request, waiting inside the agent until the
+// user is present rather than having the client poll. See WaitRequest and
+// WaitResponse
+const WaitExtension = "u2f-wait@e43.eu"
+
+// WaitRequest is the body of a WaitExtension request
+type WaitRequest struct {
+	// Key is the u2f key to send the request to. If empty, the request goes
+	// to every device and the first to succeed answers
+	Key []byte
+	// Message is the U2F request APDU
+	Message []byte
+	// Timeout is how long to wait for presence in milliseconds, or 0 for
+	// the agent's default
+	Timeout uint32
+}
+
+// WaitResponse is the body of a WaitExtension response
+type WaitResponse struct {
+	// Key is the u2f key of the device which answered
+	Key []byte
+	// Response is the device's response APDU, including the status word
+	Response []byte
+}
@@ -2,25 +2,56 @@
 package u2fproxy
 
 import (
+	"time"
+
+	"github.com/erincandescent/ssh-emissary/lib"
+	"github.com/erincandescent/ssh-emissary/u2fproto"
 	"github.com/flynn/u2f/u2ftoken"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	sshagent "golang.org/x/crypto/ssh/agent"
 )
 
 type proxyDevice struct {
 	agent sshagent.Agent
 	key   sshagent.Key
+	// version is the negotiated protocol version, or 0 if we haven't yet
+	version uint32
+	timeout time.Duration
 }
 
 var _ u2ftoken.Device = &proxyDevice{}
 
-func NewProxyDevice(agent sshagent.Agent, key sshagent.Key) u2ftoken.Device {
+// NewProxyDevice returns a device which sends requests to the u2f key
+// through the agent. If the agent supports it, requests wait in the
+// agent for user presence, for up to timeout (or the agent's default,
+// if 0)
+func NewProxyDevice(agent sshagent.Agent, key sshagent.Key, timeout time.Duration) u2ftoken.Device {
 	return &proxyDevice{
-		agent: agent,
-		key:   key,
+		agent:   agent,
+		key:     key,
+		timeout: timeout,
 	}
 }
 
 func (d *proxyDevice) Message(data []byte) ([]byte, error) {
+	if d.version == 0 {
+		v, err := NegotiateVersion(d.agent)
+		if err != nil {
+			return nil, err
+		}
+		d.version = v
+	}
+
+	// The version applies to the whole agent, but the agent may be made up
+	// of several which don't all support waiting
+	if d.version >= u2fproto.ProtocolVersion2 {
+		resp, err := Wait(d.agent, d.key.Blob, data, d.timeout)
+		if err != sshagent.ErrExtensionUnsupported {
+			return resp, err
+		}
+	}
+
 	sig, err := d.agent.Sign(&d.key, data)
 	if err != nil {
 		return nil, err
@@ -28,3 +59,64 @@ func (d *proxyDevice) Message(data []byte) ([]byte, error) {
 		return sig.Blob, nil
 	}
 }
+
+type anyDevice struct {
+	agent   sshagent.Agent
+	timeout time.Duration
+}
+
+// NewAnyDevice returns a device which sends each request to every U2F
+// device connected to the agent, answering with the first to succeed.
+// Requests fail with agent.ErrExtensionUnsupported if the agent doesn't
+// support u2fproto.ProtocolVersion2. Requests wait for up to timeout, as
+// for NewProxyDevice
+func NewAnyDevice(agent sshagent.Agent, timeout time.Duration) u2ftoken.Device {
+	return &anyDevice{agent, timeout}
+}
+
+func (d *anyDevice) Message(data []byte) ([]byte, error) {
+	return Wait(d.agent, nil, data, d.timeout)
+}
+
+// NegotiateVersion agrees a protocol version with the agent
+func NegotiateVersion(agent sshagent.Agent) (uint32, error) {
+	req := u2fproto.VersionRequest{
+		MinVersion: u2fproto.ProtocolVersion1,
+		MaxVersion: u2fproto.ProtocolVersion,
+	}
+
+	res, err := lib.CallExtension(agent, u2fproto.VersionExtension, ssh.Marshal(&req))
+	if err == sshagent.ErrExtensionUnsupported {
+		return u2fproto.ProtocolVersion1, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "Negotiating U2F protocol version")
+	}
+
+	var vr u2fproto.VersionResponse
+	if err := ssh.Unmarshal(res, &vr); err != nil {
+		return 0, err
+	}
+	return vr.Version, nil
+}
+
+// Wait sends a request to the device with the given key (or any device, if
+// key is nil), waiting in the agent for user presence for up to timeout,
+// or the agent's default if 0
+func Wait(agent sshagent.Agent, key []byte, data []byte, timeout time.Duration) ([]byte, error) {
+	req := u2fproto.WaitRequest{
+		Key:     key,
+		Message: data,
+		Timeout: uint32(timeout / time.Millisecond),
+	}
+
+	res, err := lib.CallExtension(agent, u2fproto.WaitExtension, ssh.Marshal(&req))
+	if err != nil {
+		return nil, err
+	}
+
+	var wr u2fproto.WaitResponse
+	if err := ssh.Unmarshal(res, &wr); err != nil {
+		return nil, err
+	}
+	return wr.Response, nil
+}
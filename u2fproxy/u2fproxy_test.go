@@ -0,0 +1,146 @@
+package u2fproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// Test vectors from docs/protocol.md
+const (
+	keyBlob = `0000000a753266406534332e6575000102030405060708090a0b0c0d0e0f10111213
+		14151617aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`
+
+	versionRequest  = `0000001f1b000000127532662d76657273696f6e406534332e65750000000100000002`
+	versionResponse = `000000050600000002`
+
+	signRequest = `0000004a0d000000360000000a753266406534332e6575000102030405060708090a0b
+		0c0d0e0f1011121314151617aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa00000007000300
+		0000000000000000`
+	signResponse = `000000180e0000001300000003753266000000085532465f56329000`
+
+	waitRequest = `0000005d1b0000000f7532662d77616974406534332e6575000000360000000a753266
+		406534332e6575000102030405060708090a0b0c0d0e0f1011121314151617aaaaaaaa
+		aaaaaaaaaaaaaaaaaaaaaaaa000000070003000000000000000000`
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// fakeAgent answers each request on an agent connection with the next of
+// responses, recording the requests
+func fakeAgent(t *testing.T, responses ...string) (sshagent.ExtendedAgent, *[][]byte) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var requests [][]byte
+	go func() {
+		defer server.Close()
+		for _, res := range responses {
+			var length [4]byte
+			if _, err := io.ReadFull(server, length[:]); err != nil {
+				return
+			}
+			req := make([]byte, 4+binary.BigEndian.Uint32(length[:]))
+			copy(req, length[:])
+			if _, err := io.ReadFull(server, req[4:]); err != nil {
+				return
+			}
+			requests = append(requests, req)
+			server.Write(unhex(res))
+		}
+	}()
+	return sshagent.NewClient(client), &requests
+}
+
+func checkRequest(t *testing.T, got []byte, want string) {
+	t.Helper()
+	if !bytes.Equal(got, unhex(want)) {
+		t.Errorf("Sent\n%x\nwant\n%x", got, unhex(want))
+	}
+}
+
+var versionAPDU = []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+func TestNegotiateVersion(t *testing.T) {
+	agent, requests := fakeAgent(t, versionResponse)
+
+	v, err := NegotiateVersion(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Errorf("Negotiated version %d", v)
+	}
+	checkRequest(t, (*requests)[0], versionRequest)
+}
+
+func TestSign(t *testing.T) {
+	// An agent without u2f-version@e43.eu speaks version 1
+	agent, requests := fakeAgent(t, "0000000105", signResponse)
+
+	dev := NewProxyDevice(agent, sshagent.Key{Format: "u2f", Blob: unhex(keyBlob)}, 0)
+	resp, err := dev.Message(versionAPDU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "U2F_V2\x90\x00" {
+		t.Errorf("Got response %x", resp)
+	}
+	checkRequest(t, (*requests)[1], signRequest)
+}
+
+func TestWait(t *testing.T) {
+	// The response has an empty key blob and the response APDU
+	agent, requests := fakeAgent(t, "000000110600000000000000085532465f56329000")
+
+	resp, err := Wait(agent, unhex(keyBlob), versionAPDU, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "U2F_V2\x90\x00" {
+		t.Errorf("Got response %x", resp)
+	}
+	checkRequest(t, (*requests)[0], waitRequest)
+}
+
+func TestWaitTimeout(t *testing.T) {
+	agent, requests := fakeAgent(t, "000000110600000000000000085532465f56329000")
+
+	if _, err := NewAnyDevice(agent, 90*time.Second).Message(versionAPDU); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is empty, and the timeout 90000ms
+	checkRequest(t, (*requests)[0], `000000271b0000000f7532662d77616974406534332e6575
+		00000000000000070003000000000000015f90`)
+}
+
+func TestWaitFallback(t *testing.T) {
+	// The agent speaks version 2, but not for this key
+	agent, requests := fakeAgent(t, versionResponse, "0000000105", signResponse)
+
+	dev := NewProxyDevice(agent, sshagent.Key{Format: "u2f", Blob: unhex(keyBlob)}, 0)
+	resp, err := dev.Message(versionAPDU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "U2F_V2\x90\x00" {
+		t.Errorf("Got response %x", resp)
+	}
+	checkRequest(t, (*requests)[1], waitRequest)
+	checkRequest(t, (*requests)[2], signRequest)
+}